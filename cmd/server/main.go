@@ -1,12 +1,17 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"path/filepath"
 
 	"avatar-face-swap-go/internal/config"
 	"avatar-face-swap-go/internal/database"
 	"avatar-face-swap-go/internal/handler"
 	"avatar-face-swap-go/internal/middleware"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/internal/storage"
 
 	"github.com/gin-contrib/cors"
 
@@ -14,8 +19,37 @@ import (
 )
 
 func main() {
+	migrate := flag.String("migrate", "", `manage schema migrations and exit: "status" lists pending migrations, "up" applies them`)
+	backup := flag.Bool("backup", false, "back up the database and storage to BACKUP_DIR and exit")
+	restore := flag.String("restore", "", "replace the database and storage with a backup archive and exit (stop the server first)")
+	flag.Parse()
+
 	cfg := config.Load()
 
+	if *migrate != "" {
+		if err := runMigrateCommand(cfg.DatabaseURL, *migrate); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	if *backup {
+		if err := runBackupCommand(cfg); err != nil {
+			log.Fatalf("Backup failed: %v", err)
+		}
+		return
+	}
+
+	if *restore != "" {
+		if err := storage.Init(cfg); err != nil {
+			log.Fatalf("Failed to initialize storage: %v", err)
+		}
+		if err := service.RestoreBackup(*restore, cfg.DatabaseURL); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		return
+	}
+
 	// Set Gin mode based on environment
 	if cfg.IsProduction() {
 		gin.SetMode(gin.ReleaseMode)
@@ -27,12 +61,27 @@ func main() {
 
 	defer database.Close()
 
+	if err := storage.Init(cfg); err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	if err := service.ImportLegacyMetadata(); err != nil {
+		log.Fatalf("Failed to import legacy metadata: %v", err)
+	}
+
+	if err := service.StartDetectionWorkers(cfg); err != nil {
+		log.Fatalf("Failed to start detection workers: %v", err)
+	}
+	service.StartTrashPurger(cfg)
+	service.StartBackupScheduler(cfg)
+	service.StartGarbageCollector(cfg)
+
 	router := gin.Default()
 
 	// CORS configuration from environment
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     cfg.GetCORSOrigins(),
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
 		AllowCredentials: true,
 	}))
@@ -58,31 +107,61 @@ func main() {
 
 		// Event
 		api.GET("/events", middleware.AuthRequired(), middleware.AdminRequired(), handler.ListEvents)
-		api.GET("/events/:id", middleware.AuthRequired(), handler.GetEvent)
+		api.GET("/events/:id", middleware.AuthRequired(), middleware.EventPermission(), handler.GetEvent)
 		api.POST("/events", middleware.AuthRequired(), middleware.AdminRequired(), handler.CreateEvent)
+		api.POST("/events/import", middleware.AuthRequired(), middleware.AdminRequired(), handler.ImportEvent) // Create an event from an exported archive
 		api.PUT("/events/:id", middleware.AuthRequired(), middleware.AdminRequired(), handler.UpdateEvent)
 		api.DELETE("/events/:id", middleware.AuthRequired(), middleware.AdminRequired(), handler.DeleteEvent)
 		api.GET("/events/:id/token", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetEventToken)
+		api.GET("/events/:id/export", middleware.AuthRequired(), middleware.AdminRequired(), handler.ExportEvent) // Download the event as a zip archive
+		api.GET("/events/:id/usage", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetEventUsage)  // Disk usage of the event's files
 		api.GET("/events/:id/status", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetProcessStatus) // Get face detection status
+		api.POST("/events/:id/restore", middleware.AuthRequired(), middleware.AdminRequired(), handler.RestoreEvent)   // Restore a deleted event from the trash
+
+		// Trash (deleted events)
+		api.GET("/trash/events", middleware.AuthRequired(), middleware.AdminRequired(), handler.ListTrashedEvents)   // List deleted events
+		api.DELETE("/trash/events/:id", middleware.AuthRequired(), middleware.AdminRequired(), handler.PurgeEvent)   // Permanently delete an event
 
 		// Picture (event main image)
-		api.GET("/events/:id/picture", middleware.AuthRequired(), handler.GetEventPic)                                       // Get event picture
+		api.GET("/events/:id/picture", middleware.AuthRequired(), middleware.EventPermission(), handler.GetEventPic)                                       // Get event picture
 		api.GET("/events/:id/picture/metadata", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetEventPicInfo) // Get picture metadata
 		api.PUT("/events/:id/picture", middleware.AuthRequired(), middleware.AdminRequired(), handler.UploadEventPic)        // Upload/replace event picture
+		api.POST("/events/:id/picture/reprocess", middleware.AuthRequired(), middleware.AdminRequired(), handler.ReprocessEventPic) // Re-run face detection, keeping manual faces and avatars
+		api.GET("/events/:id/composite", middleware.AuthRequired(), middleware.EventPermission(), handler.GetEventComposite)                                // Get face-swapped picture
 
 		// Faces
-		api.GET("/events/:id/faces", middleware.AuthRequired(), handler.GetEventFaces)                                           // List faces
+		api.GET("/events/:id/faces", middleware.AuthRequired(), middleware.EventPermission(), handler.GetEventFaces)                                           // List faces
 		api.GET("/events/:id/faces/metadata", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetEventMetadata)   // Get faces metadata
-		api.GET("/events/:id/faces/:filename", middleware.AuthRequired(), handler.GetFaceImage)                                  // Get face image
+		api.GET("/events/:id/faces/:filename", middleware.AuthRequired(), middleware.EventPermission(), handler.GetFaceImage)                                  // Get face image
 		api.POST("/events/:id/faces", middleware.AuthRequired(), middleware.AdminRequired(), handler.AddManualFace)              // Add manual face
-		api.POST("/events/:id/faces/:face/avatar", middleware.AuthRequired(), handler.UploadAvatar)       // Upload avatar for a face
-		api.GET("/events/:id/avatars/:filename", middleware.AuthRequired(), handler.GetUploadedAvatar)    // Get uploaded avatar
+		api.POST("/events/:id/faces/:face/avatar", middleware.AuthRequired(), middleware.EventPermission(), handler.UploadAvatar)       // Upload avatar for a face
+		api.GET("/events/:id/avatars/:filename", middleware.AuthRequired(), middleware.EventPermission(), handler.GetUploadedAvatar)    // Get uploaded avatar
+		api.GET("/events/:id/faces/:filename/avatars", middleware.AuthRequired(), middleware.AdminRequired(), handler.ListAvatarVersions)         // List avatar versions of a face
+		api.GET("/events/:id/faces/:filename/avatars/:version", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetAvatarVersion) // Get one avatar version
+		api.POST("/events/:id/faces/:face/avatars/:version/rollback", middleware.AuthRequired(), middleware.AdminRequired(), handler.RollbackAvatar) // Make an avatar version current again
+		api.PATCH("/events/:id/faces/:filename", middleware.AuthRequired(), middleware.AdminRequired(), handler.UpdateFaceBox) // Move/resize a face box
 		api.DELETE("/events/:id/faces/:filename", middleware.AuthRequired(), middleware.AdminRequired(), handler.DeleteFace)
 
 		// QQ integration
-		api.GET("/events/:id/qq-profiles/:qq", middleware.AuthRequired(), handler.GetQQNickname)              // Get QQ nickname
-		api.POST("/events/:id/faces/:face/qq-avatar", middleware.AuthRequired(), handler.UploadQQAvatar)      // Upload QQ avatar for a face
-		api.GET("/events/:id/faces/:filename/qq-profile", middleware.AuthRequired(), handler.GetFaceQQInfo)   // Get QQ info for a face
+		api.GET("/events/:id/qq-profiles/:qq", middleware.AuthRequired(), middleware.EventPermission(), handler.GetQQNickname)              // Get QQ nickname
+		api.POST("/events/:id/faces/:face/qq-avatar", middleware.AuthRequired(), middleware.EventPermission(), handler.UploadQQAvatar)      // Upload QQ avatar for a face
+		api.GET("/events/:id/faces/:filename/qq-profile", middleware.AuthRequired(), middleware.EventPermission(), handler.GetFaceQQInfo)   // Get QQ info for a face
+
+		// Face claims (participants change only the avatar of the face they claimed)
+		api.GET("/events/:id/claims", middleware.AuthRequired(), middleware.EventPermission(), handler.ListFaceClaims)                      // List claimed faces
+		api.POST("/events/:id/faces/:face/claim", middleware.AuthRequired(), middleware.EventPermission(), handler.ClaimFace)                // Claim a face
+		api.DELETE("/events/:id/faces/:filename/claim", middleware.AuthRequired(), middleware.EventPermission(), handler.ReleaseFaceClaim)  // Release a claim (own, or any as admin)
+		api.PUT("/events/:id/faces/:face/claim", middleware.AuthRequired(), middleware.AdminRequired(), handler.ReassignFaceClaim)          // Assign a face to a session
+
+		// Storage usage
+		api.GET("/usage", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetUsageReport) // Disk usage per event and quotas
+		api.GET("/gc/orphans", middleware.AuthRequired(), middleware.AdminRequired(), handler.ListOrphans)   // List orphaned files (dry run)
+		api.POST("/gc", middleware.AuthRequired(), middleware.AdminRequired(), handler.CollectGarbage)       // Delete orphaned files
+
+		// Backup
+		api.GET("/backups", middleware.AuthRequired(), middleware.AdminRequired(), handler.ListBackups)           // List backups
+		api.POST("/backups", middleware.AuthRequired(), middleware.AdminRequired(), handler.CreateBackup)         // Back up database and storage now
+		api.GET("/backups/:name", middleware.AuthRequired(), middleware.AdminRequired(), handler.DownloadBackup)  // Download a backup archive
 
 		// log
 		api.GET("/logs", middleware.AuthRequired(), middleware.AdminRequired(), handler.GetLogs)
@@ -91,3 +170,54 @@ func main() {
 	log.Printf("Server starting on :%s", cfg.Port)
 	router.Run(":" + cfg.Port)
 }
+
+// runMigrateCommand handles the -migrate flag without starting the server
+func runMigrateCommand(dbPath, command string) error {
+	if err := database.Open(dbPath); err != nil {
+		return err
+	}
+	defer database.Close()
+
+	switch command {
+	case "status":
+		pending, err := database.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			fmt.Println("Database schema is up to date")
+			return nil
+		}
+		fmt.Printf("%d pending migrations:\n", len(pending))
+		for _, m := range pending {
+			fmt.Printf("  %d %s\n", m.Version, m.Name)
+		}
+		return nil
+	case "up":
+		return database.Migrate()
+	default:
+		return fmt.Errorf("unknown -migrate command %q, expected status or up", command)
+	}
+}
+
+// runBackupCommand handles the -backup flag without starting the server
+func runBackupCommand(cfg *config.Config) error {
+	if err := database.Open(cfg.DatabaseURL); err != nil {
+		return err
+	}
+	defer database.Close()
+
+	if err := storage.Init(cfg); err != nil {
+		return err
+	}
+
+	backup, err := service.CreateBackup(cfg.BackupDir)
+	if err != nil {
+		return err
+	}
+	if _, err := service.PruneBackups(cfg.BackupDir, cfg.BackupKeep); err != nil {
+		return err
+	}
+	fmt.Printf("Backup written to %s (%d bytes)\n", filepath.Join(cfg.BackupDir, backup.Name), backup.Size)
+	return nil
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/joho/godotenv"
 )
@@ -17,6 +19,66 @@ type Config struct {
 	TencentSecretID  string
 	TencentSecretKey string
 	TencentRegion    string
+	TencentEndpoint  string
+
+	// Blob storage for pictures, faces and avatars: local (StorageDir) or s3
+	StorageBackend string
+	// S3-compatible object store (AWS S3, MinIO, ...)
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3UsePathStyle    bool
+	// Lifetime of presigned download URLs; 0 proxies downloads through the server
+	S3PresignTTLSeconds int
+
+	// Days a deleted event stays in the trash before it is purged; 0 keeps it until purged by hand
+	TrashRetentionDays int
+
+	// Storage quotas in megabytes, 0 for no limit: size of one avatar, total
+	// size of one event's files and total size of all stored files
+	MaxAvatarSizeMB int
+	EventQuotaMB    int
+	StorageQuotaMB  int
+
+	// Orphaned file collection: hours between scheduled runs (0 disables the
+	// schedule) and the age below which files are never collected
+	GCIntervalHours int
+	GCMinAgeHours   int
+
+	// Backups of the database and storage: target directory, hours between
+	// scheduled backups (0 disables the schedule) and how many to keep
+	BackupDir           string
+	BackupIntervalHours int
+	BackupKeep          int
+
+	// Tencent API call limits: requests per second across the process, and
+	// retries of throttled or transient failures with exponential backoff
+	TencentQPS         float64
+	TencentMaxRetries  int
+	TencentRetryBaseMs int
+	TencentRetryMaxMs  int
+
+	// Face detection provider: tencent, local, mock
+	FaceDetector string
+	// Pico cascade file for the local detector; empty uses the built-in facefinder
+	LocalCascadePath string
+	// Boxes used by the mock detector when no sidecar sits next to the image
+	MockFacesFile string
+
+	// Face detection job queue: concurrent workers and attempts per job
+	DetectionWorkers     int
+	DetectionMaxAttempts int
+
+	// Detect faces on overlapping tiles at native resolution instead of a
+	// downscaled copy, for very large group photos
+	TiledDetection       bool
+	DetectionTileSize    int
+	DetectionTileOverlap int
+
+	// Run AnalyzeFace on every detected face of events aligned by landmarks
+	DetectLandmarks bool
 
 	// Keycloak OIDC configuration
 	KeycloakClientID     string
@@ -33,13 +95,20 @@ type Config struct {
 	Environment string
 }
 
+var (
+	currentMu sync.Mutex
+	current   *Config
+)
+
+// Load reads the configuration from the environment and the .env file, and
+// makes it the one Current returns
 func Load() *Config {
 	// Load .env file (ignore error if not exists)
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found, using system environment")
 	}
 
-	return &Config{
+	cfg := &Config{
 		Port:             getEnv("PORT", "5001"),
 		JWTSecret:        getEnv("JWT_SECRET", "dev-secret-key"),
 		AdminPassword:    getEnv("ADMIN_PASSWORD", "admin123"),
@@ -48,6 +117,46 @@ func Load() *Config {
 		TencentSecretID:  getEnv("TENCENTCLOUD_SECRET_ID", ""),
 		TencentSecretKey: getEnv("TENCENTCLOUD_SECRET_KEY", ""),
 		TencentRegion:    getEnv("TENCENT_REGION", "ap-guangzhou"),
+		TencentEndpoint:  getEnv("TENCENT_IAI_ENDPOINT", "iai.tencentcloudapi.com"),
+
+		StorageBackend:      getEnv("STORAGE_BACKEND", "local"),
+		S3Endpoint:          getEnv("S3_ENDPOINT", ""),
+		S3Region:            getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:            getEnv("S3_BUCKET", ""),
+		S3AccessKeyID:       getEnv("S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey:   getEnv("S3_SECRET_ACCESS_KEY", ""),
+		S3UsePathStyle:      getEnv("S3_USE_PATH_STYLE", "true") == "true",
+		S3PresignTTLSeconds: getEnvInt("S3_PRESIGN_TTL_SECONDS", 900),
+
+		TrashRetentionDays: getEnvInt("TRASH_RETENTION_DAYS", 30),
+
+		MaxAvatarSizeMB: getEnvInt("MAX_AVATAR_SIZE_MB", 10),
+		EventQuotaMB:    getEnvInt("EVENT_QUOTA_MB", 0),
+		StorageQuotaMB:  getEnvInt("STORAGE_QUOTA_MB", 0),
+
+		GCIntervalHours: getEnvInt("GC_INTERVAL_HOURS", 0),
+		GCMinAgeHours:   getEnvInt("GC_MIN_AGE_HOURS", 24),
+
+		BackupDir:           getEnv("BACKUP_DIR", "./data/backups"),
+		BackupIntervalHours: getEnvInt("BACKUP_INTERVAL_HOURS", 0),
+		BackupKeep:          getEnvInt("BACKUP_KEEP", 7),
+
+		TencentQPS:         getEnvFloat("TENCENT_QPS", 5),
+		TencentMaxRetries:  getEnvInt("TENCENT_MAX_RETRIES", 3),
+		TencentRetryBaseMs: getEnvInt("TENCENT_RETRY_BASE_MS", 500),
+		TencentRetryMaxMs:  getEnvInt("TENCENT_RETRY_MAX_MS", 8000),
+
+		FaceDetector:     getEnv("FACE_DETECTOR", "tencent"),
+		LocalCascadePath: getEnv("LOCAL_CASCADE_PATH", ""),
+		MockFacesFile:    getEnv("MOCK_FACES_FILE", ""),
+		DetectLandmarks:  getEnv("DETECT_LANDMARKS", "true") == "true",
+
+		TiledDetection:       getEnv("TILED_DETECTION", "false") == "true",
+		DetectionTileSize:    getEnvInt("DETECTION_TILE_SIZE", 2000),
+		DetectionTileOverlap: getEnvInt("DETECTION_TILE_OVERLAP", 300),
+
+		DetectionWorkers:     getEnvInt("DETECTION_WORKERS", 2),
+		DetectionMaxAttempts: getEnvInt("DETECTION_MAX_ATTEMPTS", 3),
 
 		// Keycloak
 		KeycloakClientID:     getEnv("KEYCLOAK_CLIENT_ID", ""),
@@ -63,6 +172,23 @@ func Load() *Config {
 		// Environment
 		Environment: getEnv("GIN_MODE", "debug"),
 	}
+
+	currentMu.Lock()
+	current = cfg
+	currentMu.Unlock()
+	return cfg
+}
+
+// Current returns the configuration of the last Load, loading it on first
+// use. Code that runs per request or job uses it so .env is read only once.
+func Current() *Config {
+	currentMu.Lock()
+	cfg := current
+	currentMu.Unlock()
+	if cfg == nil {
+		return Load()
+	}
+	return cfg
 }
 
 // IsKeycloakEnabled returns true if Keycloak is configured
@@ -103,3 +229,29 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s: %q, using %g", key, value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
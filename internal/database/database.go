@@ -11,7 +11,16 @@ import (
 
 var DB *sql.DB
 
+// Init connects to the database and applies pending migrations
 func Init(dbPath string) error {
+	if err := Open(dbPath); err != nil {
+		return err
+	}
+	return Migrate()
+}
+
+// Open connects to the database without touching the schema
+func Open(dbPath string) error {
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
@@ -27,8 +36,14 @@ func Init(dbPath string) error {
 		return err
 	}
 	log.Printf("Database connected: %s", dbPath)
+	return nil
+}
 
-	return createTables()
+// Snapshot writes a consistent copy of the open database to dst, which must
+// not exist yet. Writers are only blocked while the copy is made.
+func Snapshot(dst string) error {
+	_, err := DB.Exec(`VACUUM INTO ?`, dst)
+	return err
 }
 
 func Close() error {
@@ -37,30 +52,3 @@ func Close() error {
 	}
 	return nil
 }
-
-func createTables() error {
-	schema := `
-    CREATE TABLE IF NOT EXISTS event (
-        event_id    INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-        description TEXT NOT NULL,
-        token       TEXT NOT NULL,
-        event_date  TEXT NOT NULL,
-        is_open     INTEGER DEFAULT 0,
-        creator     TEXT
-    );
-
-    CREATE TABLE IF NOT EXISTS system_log (
-        id          INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-        timestamp   DATETIME DEFAULT CURRENT_TIMESTAMP,
-        level       TEXT NOT NULL,
-        module      TEXT NOT NULL,
-        action      TEXT NOT NULL,
-        user_id     TEXT,
-        event_id    TEXT,
-        ip_address  TEXT,
-        details     TEXT
-    );
-    `
-	_, err := DB.Exec(schema)
-	return err
-}
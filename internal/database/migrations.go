@@ -0,0 +1,277 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Migration is one numbered step of the schema. Migrations are applied in
+// order, each in its own transaction, and recorded in schema_migrations.
+// Never edit a released migration: append a new one instead.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// Databases created before migrations existed already have some of these
+// tables and columns, so the early steps only create what is missing.
+var migrations = []Migration{
+	{1, "initial_schema", execSQL(`
+    CREATE TABLE IF NOT EXISTS event (
+        event_id    INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        description TEXT NOT NULL,
+        token       TEXT NOT NULL,
+        event_date  TEXT NOT NULL,
+        is_open     INTEGER DEFAULT 0,
+        creator     TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS system_log (
+        id          INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        timestamp   DATETIME DEFAULT CURRENT_TIMESTAMP,
+        level       TEXT NOT NULL,
+        module      TEXT NOT NULL,
+        action      TEXT NOT NULL,
+        user_id     TEXT,
+        event_id    TEXT,
+        ip_address  TEXT,
+        details     TEXT
+    );
+    `)},
+	{2, "event_composite_settings", addColumn("event", "composite_settings", "TEXT")},
+	{3, "detection_job", func(tx *sql.Tx) error {
+		if err := execSQL(`
+    CREATE TABLE IF NOT EXISTS detection_job (
+        id          INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        event_id    INTEGER NOT NULL,
+        status      TEXT NOT NULL,
+        attempts    INTEGER NOT NULL DEFAULT 0,
+        error       TEXT,
+        faces_count INTEGER,
+        created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+        started_at  DATETIME,
+        finished_at DATETIME
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_detection_job_event ON detection_job (event_id);
+    CREATE INDEX IF NOT EXISTS idx_detection_job_status ON detection_job (status);
+    `)(tx); err != nil {
+			return err
+		}
+		if err := addColumn("detection_job", "mode", "TEXT NOT NULL DEFAULT 'replace'")(tx); err != nil {
+			return err
+		}
+		return addColumn("detection_job", "report", "TEXT")(tx)
+	}},
+	{4, "event_detection_settings", addColumn("event", "detection_settings", "TEXT")},
+	{5, "face_and_avatar", func(tx *sql.Tx) error {
+		if err := execSQL(`
+    CREATE TABLE IF NOT EXISTS face (
+        id          INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        event_id    INTEGER NOT NULL,
+        filename    TEXT NOT NULL,
+        x1          INTEGER NOT NULL,
+        y1          INTEGER NOT NULL,
+        x2          INTEGER NOT NULL,
+        y2          INTEGER NOT NULL,
+        confidence  REAL,
+        manual      INTEGER NOT NULL DEFAULT 0,
+        face_id     TEXT,
+        landmarks   TEXT,
+        pose        TEXT,
+        quality     TEXT,
+        created_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (event_id, filename)
+    );
+
+    CREATE TABLE IF NOT EXISTS avatar (
+        id          INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        event_id    INTEGER NOT NULL,
+        face        TEXT NOT NULL,
+        filename    TEXT NOT NULL,
+        source      TEXT NOT NULL,
+        qq_number   TEXT,
+        created_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_avatar_event_face ON avatar (event_id, face);
+    `)(tx); err != nil {
+			return err
+		}
+		if err := addColumn("event", "picture_width", "INTEGER")(tx); err != nil {
+			return err
+		}
+		return addColumn("event", "picture_height", "INTEGER")(tx)
+	}},
+	{6, "event_deleted_at", func(tx *sql.Tx) error {
+		if err := addColumn("event", "deleted_at", "DATETIME")(tx); err != nil {
+			return err
+		}
+		return execSQL(`CREATE INDEX IF NOT EXISTS idx_event_deleted_at ON event (deleted_at)`)(tx)
+	}},
+	// Each avatar upload becomes a numbered version; the existing avatar of a
+	// face is its version 1 and current
+	{7, "avatar_versions", func(tx *sql.Tx) error {
+		for _, col := range []struct{ name, def string }{
+			{"version", "INTEGER NOT NULL DEFAULT 1"},
+			{"is_current", "INTEGER NOT NULL DEFAULT 1"},
+			{"uploaded_by", "TEXT"},
+			{"uploader_ip", "TEXT"},
+		} {
+			if err := addColumn("avatar", col.name, col.def)(tx); err != nil {
+				return err
+			}
+		}
+		return execSQL(`
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_avatar_version ON avatar (event_id, face, version);
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_avatar_current ON avatar (event_id, face) WHERE is_current = 1;
+    `)(tx)
+	}},
+	// A participant session holds at most one face per event
+	{8, "face_claim", execSQL(`
+    CREATE TABLE IF NOT EXISTS face_claim (
+        event_id    INTEGER NOT NULL,
+        face        TEXT NOT NULL,
+        session_id  TEXT NOT NULL,
+        claimed_at  DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (event_id, face)
+    );
+
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_face_claim_session ON face_claim (event_id, session_id);
+    `)},
+	// Failed detection jobs wait before their next attempt
+	{9, "detection_job_retry_at", addColumn("detection_job", "retry_at", "DATETIME")},
+}
+
+// PendingMigrations returns the migrations not yet applied to the database
+func PendingMigrations() ([]Migration, error) {
+	applied, err := appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies every pending migration in order. A failing migration is
+// rolled back and stops the run, leaving later ones pending.
+func Migrate() error {
+	if _, err := DB.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version     INTEGER NOT NULL PRIMARY KEY,
+        name        TEXT NOT NULL,
+        applied_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+    )`); err != nil {
+		return err
+	}
+
+	pending, err := PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+func applyMigration(m Migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// appliedVersions reads schema_migrations, treating a missing table as empty
+// so that pending migrations can be listed without writing to the database
+func appliedVersions() (map[int]bool, error) {
+	var count int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]bool{}
+	if count == 0 {
+		return applied, nil
+	}
+
+	rows, err := DB.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func execSQL(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// addColumn adds a column unless it is already there
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				cid       int
+				name      string
+				colType   string
+				notNull   int
+				dfltValue sql.NullString
+				pk        int
+			)
+			if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+				return err
+			}
+			if name == column {
+				return nil
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+		return err
+	}
+}
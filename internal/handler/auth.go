@@ -25,11 +25,11 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	cfg := config.Load()
+	cfg := config.Current()
 
 	// Check if admin password
 	if req.Token == cfg.AdminPassword {
-		jwtToken, err := service.GenerateJWT("local_admin", "admin", "")
+		jwtToken, err := service.GenerateJWT("local_admin", "admin", "", "")
 		if err != nil {
 			response.Error(c, 500, "Failed to generate token")
 			return
@@ -61,19 +61,33 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// Each participant gets a session identity that face claims are tied to;
+	// logging in again with it keeps the claim
+	sessionID := req.SessionID
+	if !service.ValidSessionID(sessionID) {
+		if sessionID, err = service.NewSessionID(); err != nil {
+			response.Error(c, 500, "Failed to generate token")
+			return
+		}
+	}
+
 	// Generate JWT with event_id as role
-	jwtToken, err := service.GenerateJWT("local_user", formatEventID(event.ID), "")
+	jwtToken, err := service.GenerateJWT("local_user", formatEventID(event.ID), "", sessionID)
 	if err != nil {
 		response.Error(c, 500, "Failed to generate token")
 		return
 	}
 
-	service.LogActivity("INFO", "用户认证", "用户登录", "", formatEventID(event.ID), c.ClientIP(), nil)
+	service.LogActivity("INFO", "用户认证", "用户登录", "", formatEventID(event.ID), c.ClientIP(), map[string]any{
+		"session_id": sessionID,
+		"resumed":    sessionID == req.SessionID,
+	})
 
 	response.Success(c, model.LoginResponse{
 		EventID:     formatEventID(event.ID),
 		Description: event.Description,
 		Token:       jwtToken,
+		SessionID:   sessionID,
 	})
 }
 
@@ -96,9 +110,10 @@ func VerifyToken(c *gin.Context) {
 	}
 
 	response.Success(c, gin.H{
-		"user":     claims.UserID,
-		"role":     claims.Role,
-		"event_id": claims.Role,
+		"user":       claims.UserID,
+		"role":       claims.Role,
+		"event_id":   claims.Role,
+		"session_id": claims.SessionID,
 	})
 }
 
@@ -143,7 +158,7 @@ func KeycloakLogin(c *gin.Context) {
 // Keycloak callback handler - exchanges code for tokens and redirects to frontend
 func KeycloakCallback(c *gin.Context) {
 	keycloak := service.GetKeycloakService()
-	cfg := config.Load()
+	cfg := config.Current()
 
 	if !keycloak.IsEnabled() {
 		response.Error(c, 400, "Keycloak SSO is not configured")
@@ -196,7 +211,7 @@ func KeycloakCallback(c *gin.Context) {
 	}
 
 	// Generate our JWT token
-	jwtToken, err := service.GenerateJWT(username, role, userInfo.Email)
+	jwtToken, err := service.GenerateJWT(username, role, userInfo.Email, "")
 	if err != nil {
 		service.LogActivity("ERROR", "Keycloak", "生成JWT失败", username, "", c.ClientIP(), map[string]any{"error": err.Error()})
 		c.Redirect(302, cfg.FrontendBaseURL+"/event?error="+url.QueryEscape("生成令牌失败"))
@@ -217,7 +232,7 @@ func KeycloakCallback(c *gin.Context) {
 // Logout from Keycloak and redirect to frontend
 func KeycloakLogout(c *gin.Context) {
 	keycloak := service.GetKeycloakService()
-	cfg := config.Load()
+	cfg := config.Current()
 
 	if !keycloak.IsEnabled() {
 		// If Keycloak is not configured, just redirect to frontend
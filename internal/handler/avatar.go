@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/internal/storage"
+	"avatar-face-swap-go/pkg/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/events/:id/faces/:filename/avatars
+// Lists every avatar version of a face, newest first, with who uploaded it and when
+func ListAvatarVersions(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	face := c.Param("filename")
+	if filepath.Base(face) != face {
+		response.Error(c, 400, "Invalid filename")
+		return
+	}
+
+	versions, err := repository.GetAvatarVersions(eventID, face)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+
+	current := 0
+	for _, v := range versions {
+		if v.Current {
+			current = v.Version
+		}
+	}
+
+	response.Success(c, gin.H{
+		"face":     face,
+		"current":  current,
+		"versions": versions,
+	})
+}
+
+// GET /api/events/:id/faces/:filename/avatars/:version
+// Returns the image of one avatar version
+func GetAvatarVersion(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	face := c.Param("filename")
+	if filepath.Base(face) != face {
+		response.Error(c, 400, "Invalid filename")
+		return
+	}
+
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		response.Error(c, 400, "Invalid version")
+		return
+	}
+
+	avatar, err := repository.GetAvatarVersion(eventID, face, version)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+	if avatar == nil {
+		response.Error(c, 404, "Avatar version not found")
+		return
+	}
+
+	serveObject(c, storage.AvatarKey(eventID, avatar.Filename), "Avatar not found")
+}
+
+// POST /api/events/:id/faces/:face/avatars/:version/rollback
+// Makes an earlier avatar version the current one
+func RollbackAvatar(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	face := c.Param("face")
+	if filepath.Base(face) != face {
+		response.Error(c, 400, "Invalid face parameter")
+		return
+	}
+
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		response.Error(c, 400, "Invalid version")
+		return
+	}
+
+	avatar, err := service.RollbackAvatar(eventID, face, version)
+	if errors.Is(err, service.ErrAvatarVersionNotFound) {
+		response.Error(c, 404, err.Error())
+		return
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to roll back avatar: %v\n", err)
+		response.Error(c, 500, "Failed to roll back avatar")
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "图片处理", "回滚头像", userEmailStr, strconv.Itoa(eventID), c.ClientIP(), map[string]any{
+		"face":     face,
+		"version":  version,
+		"filename": avatar.Filename,
+	})
+
+	response.Success(c, gin.H{
+		"message": "Avatar rolled back",
+		"avatar":  avatar,
+	})
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/pkg/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/backups
+func ListBackups(c *gin.Context) {
+	backups, err := service.ListBackups(config.Current().BackupDir)
+	if err != nil {
+		response.Error(c, 500, "Failed to list backups")
+		return
+	}
+
+	response.Success(c, gin.H{"backups": backups})
+}
+
+// POST /api/backups
+// Backs up the database and storage now, then drops backups beyond BACKUP_KEEP
+func CreateBackup(c *gin.Context) {
+	cfg := config.Current()
+
+	backup, err := service.CreateBackup(cfg.BackupDir)
+	if err != nil {
+		fmt.Printf("Warning: backup failed: %v\n", err)
+		response.Error(c, 500, "Failed to create backup")
+		return
+	}
+	if _, err := service.PruneBackups(cfg.BackupDir, cfg.BackupKeep); err != nil {
+		fmt.Printf("Warning: failed to delete old backups: %v\n", err)
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "系统维护", "创建备份", userEmailStr, "", c.ClientIP(), map[string]any{
+		"name": backup.Name,
+		"size": backup.Size,
+	})
+
+	response.Created(c, gin.H{"backup": backup})
+}
+
+// GET /api/backups/:name
+func DownloadBackup(c *gin.Context) {
+	name := c.Param("name")
+	file, ok := service.BackupPath(config.Current().BackupDir, name)
+	if !ok {
+		response.Error(c, 400, "Invalid backup name")
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		response.Error(c, 404, "Backup not found")
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "系统维护", "下载备份", userEmailStr, "", c.ClientIP(), map[string]any{
+		"name": name,
+	})
+
+	c.FileAttachment(file, name)
+}
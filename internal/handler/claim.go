@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/pkg/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// faceClaim is a claim as shown to the caller: participants see which faces
+// are taken and which one is theirs, admins also see the sessions
+type faceClaim struct {
+	Face      string `json:"face"`
+	ClaimedAt string `json:"claimed_at"`
+	Mine      bool   `json:"mine"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// GET /api/events/:id/claims
+// Lists the claimed faces of an event
+func ListFaceClaims(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	claims, err := repository.GetFaceClaims(eventID)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+
+	sessionID, admin := callerSession(c)
+	items := make([]faceClaim, 0, len(claims))
+	for _, claim := range claims {
+		item := faceClaim{
+			Face:      claim.Face,
+			ClaimedAt: claim.ClaimedAt,
+			Mine:      sessionID != "" && claim.SessionID == sessionID,
+		}
+		if admin {
+			item.SessionID = claim.SessionID
+		}
+		items = append(items, item)
+	}
+
+	response.Success(c, gin.H{"claims": items})
+}
+
+// POST /api/events/:id/faces/:face/claim
+// Claims a face for the participant's session
+func ClaimFace(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	face := c.Param("face")
+	if filepath.Base(face) != face {
+		response.Error(c, 400, "Invalid face parameter")
+		return
+	}
+
+	sessionID, admin := callerSession(c)
+	if admin {
+		response.Error(c, 400, "Admins assign faces with PUT")
+		return
+	}
+	if sessionID == "" {
+		response.Error(c, 401, "Session expired, please log in again")
+		return
+	}
+
+	claim, err := service.ClaimFace(eventID, face, sessionID)
+	if err != nil {
+		claimError(c, err)
+		return
+	}
+
+	service.LogActivity("INFO", "活动管理", "认领人脸", "", strconv.Itoa(eventID), c.ClientIP(), map[string]any{
+		"face":       face,
+		"session_id": sessionID,
+	})
+
+	response.Success(c, gin.H{
+		"face":       claim.Face,
+		"claimed_at": claim.ClaimedAt,
+		"mine":       true,
+	})
+}
+
+// DELETE /api/events/:id/faces/:filename/claim
+// Releases a claim; participants can only release their own
+func ReleaseFaceClaim(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	face := c.Param("filename")
+	if filepath.Base(face) != face {
+		response.Error(c, 400, "Invalid filename")
+		return
+	}
+
+	claim, err := repository.GetFaceClaim(eventID, face)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+	if claim == nil {
+		response.Error(c, 404, "Face is not claimed")
+		return
+	}
+
+	sessionID, admin := callerSession(c)
+	if !admin && claim.SessionID != sessionID {
+		response.Error(c, 403, service.ErrFaceClaimed.Error())
+		return
+	}
+
+	if _, err := repository.DeleteFaceClaim(eventID, face); err != nil {
+		response.Error(c, 500, "Failed to release face")
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "活动管理", "释放人脸认领", userEmailStr, strconv.Itoa(eventID), c.ClientIP(), map[string]any{
+		"face":       face,
+		"session_id": claim.SessionID,
+	})
+
+	response.Success(c, gin.H{"message": "Face released"})
+}
+
+// PUT /api/events/:id/faces/:face/claim
+// Assigns a face to a participant session, replacing any current claimant
+func ReassignFaceClaim(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	face := c.Param("face")
+	if filepath.Base(face) != face {
+		response.Error(c, 400, "Invalid face parameter")
+		return
+	}
+
+	var req struct {
+		SessionID string `json:"session_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !service.ValidSessionID(req.SessionID) {
+		response.Error(c, 400, "Invalid session_id")
+		return
+	}
+
+	previous, err := repository.GetFaceClaim(eventID, face)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+
+	claim, err := service.ReassignFaceClaim(eventID, face, req.SessionID)
+	if err != nil {
+		claimError(c, err)
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	details := map[string]any{
+		"face":       face,
+		"session_id": req.SessionID,
+	}
+	if previous != nil {
+		details["previous_session_id"] = previous.SessionID
+	}
+	service.LogActivity("INFO", "活动管理", "重新分配人脸", userEmailStr, strconv.Itoa(eventID), c.ClientIP(), details)
+
+	response.Success(c, gin.H{"claim": claim})
+}
+
+// authorizeFace lets admins through and checks that a participant owns the
+// face, claiming it if nobody has yet. It writes the error response itself.
+func authorizeFace(c *gin.Context, eventID int, face string) bool {
+	sessionID, admin := callerSession(c)
+	if admin {
+		return true
+	}
+	if sessionID == "" {
+		response.Error(c, 401, "Session expired, please log in again")
+		return false
+	}
+
+	if err := service.CheckFaceOwner(eventID, face, sessionID); err != nil {
+		claimError(c, err)
+		return false
+	}
+	return true
+}
+
+// callerSession returns the participant session of the request and whether
+// the caller is an admin
+func callerSession(c *gin.Context) (string, bool) {
+	role, _ := c.Get("role")
+	sessionID, _ := c.Get("session_id")
+	sessionIDStr, _ := sessionID.(string)
+	return sessionIDStr, role == "admin"
+}
+
+func claimError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrFaceNotFound):
+		response.Error(c, 404, "Face not found")
+	case errors.Is(err, service.ErrFaceClaimed):
+		response.Error(c, 403, err.Error())
+	case errors.Is(err, service.ErrSessionHasClaim):
+		response.Error(c, 409, err.Error())
+	default:
+		fmt.Printf("Warning: face claim failed: %v\n", err)
+		response.Error(c, 500, "Failed to check face claim")
+	}
+}
@@ -1,9 +1,7 @@
 package handler
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
 	"strconv"
 
 	"avatar-face-swap-go/internal/model"
@@ -87,6 +85,18 @@ func UpdateEvent(c *gin.Context) {
 		response.Error(c, 400, "Invalid request: "+err.Error())
 		return
 	}
+	if req.Composite != nil {
+		if err := service.ValidateCompositeSettings(req.Composite); err != nil {
+			response.Error(c, 400, "Invalid request: "+err.Error())
+			return
+		}
+	}
+	if req.Detection != nil {
+		if err := service.ValidateDetectionSettings(req.Detection); err != nil {
+			response.Error(c, 400, "Invalid request: "+err.Error())
+			return
+		}
+	}
 
 	event, err := repository.GetEventByID(id)
 	if err != nil {
@@ -102,6 +112,9 @@ func UpdateEvent(c *gin.Context) {
 		response.Error(c, 500, "Failed to update event")
 		return
 	}
+	if req.Composite != nil {
+		service.InvalidateComposite(id)
+	}
 
 	userEmail, _ := c.Get("user_email")
 	userEmailStr, _ := userEmail.(string)
@@ -129,7 +142,9 @@ func DeleteEvent(c *gin.Context) {
 		return
 	}
 
-	if err := repository.DeleteEvent(id); err != nil {
+	// The event goes to the trash; it is purged after the retention period
+	if err := service.TrashEvent(id); err != nil {
+		fmt.Printf("Warning: failed to move event %d to trash: %v\n", id, err)
 		response.Error(c, 500, "Failed to delete event")
 		return
 	}
@@ -139,7 +154,7 @@ func DeleteEvent(c *gin.Context) {
 
 	service.LogActivity("WARNING", "活动管理", "删除活动", userEmailStr, idStr, c.ClientIP(), nil)
 
-	response.Success(c, gin.H{"message": "Event deleted"})
+	response.Success(c, gin.H{"message": "Event moved to trash"})
 }
 
 func GetEventToken(c *gin.Context) {
@@ -172,29 +187,62 @@ func GetProcessStatus(c *gin.Context) {
 		return
 	}
 
-	metadataPath := storage.GetMetadataPath(eventID)
-	originalPath := storage.GetOriginalPath(eventID)
+	job, err := repository.GetLatestDetectionJob(eventID)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
 
-	if data, err := os.ReadFile(metadataPath); err == nil {
-		var metadata map[string]any
-		if err := json.Unmarshal(data, &metadata); err == nil {
-			facesCount := 0
-			if faces, ok := metadata["faces"].([]any); ok {
-				facesCount = len(faces)
+	if job != nil {
+		var message string
+		switch job.Status {
+		case model.JobQueued:
+			message = "Waiting for a detection worker"
+			if job.Error != "" {
+				message = fmt.Sprintf("Retrying after error: %s", job.Error)
 			}
-			response.Success(c, gin.H{
-				"status":      "completed",
-				"faces_count": facesCount,
-				"message":     fmt.Sprintf("Processing completed, %d faces detected", facesCount),
-			})
-			return
+		case model.JobRunning:
+			message = "Processing in progress"
+		case model.JobSucceeded:
+			message = "Processing completed"
+			if job.FacesCount != nil {
+				message = fmt.Sprintf("Processing completed, %d faces detected", *job.FacesCount)
+			}
+		case model.JobFailed:
+			message = fmt.Sprintf("Processing failed: %s", job.Error)
 		}
+
+		response.Success(c, gin.H{
+			"job_id":      job.ID,
+			"status":      job.Status,
+			"mode":        job.Mode,
+			"attempts":    job.Attempts,
+			"error":       job.Error,
+			"retry_at":    job.RetryAt,
+			"faces_count": job.FacesCount,
+			"created_at":  job.CreatedAt,
+			"started_at":  job.StartedAt,
+			"finished_at": job.FinishedAt,
+			"report":      job.Report,
+			"message":     message,
+		})
+		return
+	}
+
+	// Pictures processed before the job queue existed have no job record
+	if metadata, err := service.LoadMetadata(eventID); err == nil {
+		response.Success(c, gin.H{
+			"status":      model.JobSucceeded,
+			"faces_count": len(metadata.Faces),
+			"message":     fmt.Sprintf("Processing completed, %d faces detected", len(metadata.Faces)),
+		})
+		return
 	}
 
-	if _, err := os.Stat(originalPath); err == nil {
+	if storage.Exists(storage.OriginalKey(eventID)) {
 		response.Success(c, gin.H{
-			"status":  "processing",
-			"message": "Processing in progress",
+			"status":  model.JobFailed,
+			"message": "No detection job recorded for this picture, upload it again",
 		})
 		return
 	}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/pkg/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/events/:id/export
+// Streams the event as a zip archive that POST /api/events/import accepts
+func ExportEvent(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	event, err := repository.GetEventByID(id)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+	if event == nil {
+		response.Error(c, 404, "Event not found")
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="event-%d.zip"`, id))
+	if err := service.ExportEvent(id, c.Writer); err != nil {
+		// The archive is already partly sent, so the client sees a broken zip
+		fmt.Printf("Warning: failed to export event %d: %v\n", id, err)
+		c.Abort()
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "活动管理", "导出活动", userEmailStr, idStr, c.ClientIP(), nil)
+}
+
+// POST /api/events/import
+// Recreates an exported event with a new ID and token
+func ImportEvent(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		response.Error(c, 400, "No file uploaded")
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		response.Error(c, 500, "Failed to read file")
+		return
+	}
+	defer f.Close()
+
+	zr, err := zip.NewReader(f, file.Size)
+	if err != nil {
+		response.Error(c, 400, "File is not a zip archive")
+		return
+	}
+
+	creator, _ := c.Get("user_email")
+	creatorStr, _ := creator.(string)
+
+	event, err := service.ImportEvent(zr, creatorStr)
+	if errors.Is(err, service.ErrInvalidArchive) {
+		response.Error(c, 400, err.Error())
+		return
+	}
+	if errors.Is(err, service.ErrQuotaExceeded) {
+		quotaError(c, err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to import event: %v\n", err)
+		response.Error(c, 500, "Failed to import event")
+		return
+	}
+
+	service.LogActivity("INFO", "活动管理", "导入活动", creatorStr, strconv.Itoa(event.ID), c.ClientIP(), map[string]any{
+		"filename": file.Filename,
+	})
+
+	response.Created(c, gin.H{
+		"message":  "Event imported",
+		"event_id": event.ID,
+		"token":    event.Token,
+	})
+}
@@ -1,17 +1,24 @@
 package handler
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	_ "image/png" // PNG decoder
-	"os"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
 	"avatar-face-swap-go/internal/service"
 	"avatar-face-swap-go/internal/storage"
 	"avatar-face-swap-go/pkg/response"
@@ -28,14 +35,73 @@ func GetEventPic(c *gin.Context) {
 		return
 	}
 
-	imagePath := storage.GetOriginalPath(eventID)
+	serveObject(c, storage.OriginalKey(eventID), "Image not found")
+}
 
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+// GET /api/events/:id/composite
+// Returns the group photo with every face replaced by its uploaded avatar
+func GetEventComposite(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	event, err := repository.GetEventByID(eventID)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+	if event == nil {
+		response.Error(c, 404, "Event not found")
+		return
+	}
+
+	if !storage.Exists(storage.OriginalKey(eventID)) {
 		response.Error(c, 404, "Image not found")
 		return
 	}
 
-	c.File(imagePath)
+	// ?debug=color shows the composite without and with colour matching side by side
+	if c.Query("debug") == "color" {
+		if role, _ := c.Get("role"); role != "admin" {
+			response.Error(c, 403, "Admin permission required")
+			return
+		}
+
+		debugImg, err := service.RenderColorMatchDebug(eventID, event.Composite)
+		if errors.Is(err, service.ErrMetadataNotFound) {
+			response.Error(c, 404, "Metadata not found")
+			return
+		}
+		if err != nil {
+			response.Error(c, 500, "Failed to render composite")
+			return
+		}
+
+		c.Header("Content-Type", "image/jpeg")
+		if err := jpeg.Encode(c.Writer, debugImg, &jpeg.Options{Quality: 90}); err != nil {
+			// The image is already partly sent, so the client sees a broken JPEG
+			fmt.Printf("Warning: failed to send colour debug composite of event %d: %v\n", eventID, err)
+		}
+		return
+	}
+
+	compositeKey, err := service.RenderComposite(eventID, event.Composite, strings.ToLower(c.DefaultQuery("format", "jpg")))
+	if errors.Is(err, service.ErrUnsupportedFormat) {
+		response.Error(c, 400, "Only jpg, png formats allowed")
+		return
+	}
+	if errors.Is(err, service.ErrMetadataNotFound) {
+		response.Error(c, 404, "Metadata not found")
+		return
+	}
+	if err != nil {
+		response.Error(c, 500, "Failed to render composite")
+		return
+	}
+
+	serveObject(c, compositeKey, "Composite not found")
 }
 
 func GetEventFaces(c *gin.Context) {
@@ -45,23 +111,22 @@ func GetEventFaces(c *gin.Context) {
 		return
 	}
 
-	facesDir := storage.GetFacesDir(eventID)
-
-	if _, err := os.Stat(facesDir); os.IsNotExist(err) {
-		response.Error(c, 404, "Faces directory not found")
+	metadata, err := service.LoadMetadata(eventID)
+	if errors.Is(err, service.ErrMetadataNotFound) {
+		response.Error(c, 404, "Faces not found")
 		return
 	}
-
-	entries, err := os.ReadDir(facesDir)
 	if err != nil {
-		response.Error(c, 500, "Failed to read faces directory")
+		response.Error(c, 500, "Failed to read faces")
 		return
 	}
 
-	var faces []string
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			faces = append(faces, entry.Name())
+	hidden := lowQualityFaces(eventID, metadata.Faces)
+
+	faces := []string{}
+	for _, face := range metadata.Faces {
+		if !hidden[face.Filename] {
+			faces = append(faces, face.Filename)
 		}
 	}
 
@@ -86,14 +151,14 @@ func GetFaceImage(c *gin.Context) {
 		return
 	}
 
-	facePath := storage.GetFacePath(eventID, filename)
-
-	if _, err := os.Stat(facePath); os.IsNotExist(err) {
-		response.Error(c, 404, "Face image not found")
-		return
-	}
+	serveObject(c, storage.FaceKey(eventID, filename), "Face image not found")
+}
 
-	c.File(facePath)
+// faceInfo is a face as returned to admins, flagged when its quality score is
+// below the event's threshold
+type faceInfo struct {
+	model.Face
+	LowQuality bool `json:"low_quality,omitempty"`
 }
 
 // GET /api/events/:id/faces/metadata
@@ -105,10 +170,8 @@ func GetEventMetadata(c *gin.Context) {
 		return
 	}
 
-	metadataPath := storage.GetMetadataPath(eventID)
-
-	data, err := os.ReadFile(metadataPath)
-	if os.IsNotExist(err) {
+	metadata, err := service.LoadMetadata(eventID)
+	if errors.Is(err, service.ErrMetadataNotFound) {
 		response.Error(c, 404, "Metadata not found")
 		return
 	}
@@ -117,13 +180,58 @@ func GetEventMetadata(c *gin.Context) {
 		return
 	}
 
-	var metadata map[string]any
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		response.Error(c, 500, "Invalid metadata format")
-		return
+	// ?min_quality=N hides faces scoring below N
+	hideBelow := 0
+	if v := c.Query("min_quality"); v != "" {
+		hideBelow, err = strconv.Atoi(v)
+		if err != nil || hideBelow < 0 || hideBelow > 100 {
+			response.Error(c, 400, "Invalid min_quality")
+			return
+		}
+	}
+
+	flagBelow := 0
+	if event, err := repository.GetEventByID(eventID); err == nil && event != nil {
+		flagBelow = event.Detection.MinQuality
 	}
 
-	response.Success(c, metadata)
+	response.Success(c, gin.H{
+		"image_info": metadata.ImageInfo,
+		"faces":      applyQualityThreshold(metadata.Faces, flagBelow, hideBelow),
+	})
+}
+
+// applyQualityThreshold marks faces scoring below flagBelow as low_quality and
+// drops those scoring below hideBelow. Faces without a score are left alone.
+func applyQualityThreshold(faces []model.Face, flagBelow, hideBelow int) []faceInfo {
+	filtered := []faceInfo{}
+	for _, face := range faces {
+		if face.Quality != nil && face.Quality.Score < hideBelow {
+			continue
+		}
+		filtered = append(filtered, faceInfo{
+			Face:       face,
+			LowQuality: service.IsLowQuality(face, flagBelow),
+		})
+	}
+	return filtered
+}
+
+// lowQualityFaces returns the faces hidden from participants by the event's
+// quality threshold
+func lowQualityFaces(eventID int, faces []model.Face) map[string]bool {
+	event, err := repository.GetEventByID(eventID)
+	if err != nil || event == nil || !event.Detection.HideLowQuality {
+		return nil
+	}
+
+	hidden := map[string]bool{}
+	for _, face := range faces {
+		if service.IsLowQuality(face, event.Detection.MinQuality) {
+			hidden[face.Filename] = true
+		}
+	}
+	return hidden
 }
 
 // PUT /api/events/:id/picture
@@ -147,16 +255,20 @@ func UploadEventPic(c *gin.Context) {
 		return
 	}
 
-	if err := storage.EnsureEventDirs(eventID); err != nil {
-		response.Error(c, 500, "Failed to create directories")
+	unlock := storage.LockEvent(eventID)
+	err = service.CheckUploadQuota(eventID, file.Size, storage.OriginalKey(eventID))
+	if err != nil {
+		unlock()
+		quotaError(c, err)
 		return
 	}
-
-	destPath := storage.GetOriginalPath(eventID)
-	if err := c.SaveUploadedFile(file, destPath); err != nil {
+	err = saveUploadedFile(file, storage.OriginalKey(eventID))
+	unlock()
+	if err != nil {
 		response.Error(c, 500, "Failed to save file")
 		return
 	}
+	service.InvalidateComposite(eventID)
 
 	userEmail, _ := c.Get("user_email")
 	userEmailStr, _ := userEmail.(string)
@@ -165,23 +277,57 @@ func UploadEventPic(c *gin.Context) {
 		"filename": file.Filename,
 	})
 
-	// Async face detection
-	go func() {
-		if err := service.ProcessEventImage(eventID, destPath); err != nil {
-			fmt.Printf("Face detection failed for event %d: %v\n", eventID, err)
-			service.LogActivity("ERROR", "图片处理", "人脸识别失败", "", strconv.Itoa(eventID), "", map[string]any{
-				"error": err.Error(),
-			})
-		} else {
-			service.LogActivity("INFO", "图片处理", "人脸识别完成", "", strconv.Itoa(eventID), "", nil)
-		}
-	}()
+	// Face detection runs on the background job queue
+	jobID, err := service.EnqueueDetection(eventID, model.JobModeReplace)
+	if err != nil {
+		response.Error(c, 500, "Failed to queue face detection")
+		return
+	}
 
 	c.JSON(202, gin.H{
 		"success": true,
 		"data": gin.H{
 			"message":  "Image uploaded, processing faces",
 			"event_id": eventID,
+			"job_id":   jobID,
+		},
+	})
+}
+
+// POST /api/events/:id/picture/reprocess
+// Re-runs face detection on the current picture, keeping manual faces and
+// moving avatars to the matching new faces. The job status carries the report.
+func ReprocessEventPic(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	if !storage.Exists(storage.OriginalKey(eventID)) {
+		response.Error(c, 404, "Original image not found")
+		return
+	}
+
+	jobID, err := service.EnqueueDetection(eventID, model.JobModeMerge)
+	if err != nil {
+		response.Error(c, 500, "Failed to queue face detection")
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "图片处理", "重新识别人脸", userEmailStr, strconv.Itoa(eventID), c.ClientIP(), map[string]any{
+		"job_id": jobID,
+	})
+
+	c.JSON(202, gin.H{
+		"success": true,
+		"data": gin.H{
+			"message":  "Reprocessing faces",
+			"event_id": eventID,
+			"job_id":   jobID,
 		},
 	})
 }
@@ -213,25 +359,60 @@ func UploadAvatar(c *gin.Context) {
 		return
 	}
 
-	if err := storage.EnsureEventDirs(eventID); err != nil {
-		response.Error(c, 500, "Failed to create directories")
+	if err := service.CheckAvatarSize(file.Size); err != nil {
+		quotaError(c, err)
 		return
 	}
 
-	baseName := face[:len(face)-len(filepath.Ext(face))]
-	destPath := storage.GetAvatarPath(eventID, baseName+ext)
+	if !authorizeFace(c, eventID, face) {
+		return
+	}
 
-	if err := c.SaveUploadedFile(file, destPath); err != nil {
+	src, err := file.Open()
+	if err != nil {
 		response.Error(c, 500, "Failed to save file")
 		return
 	}
+	defer src.Close()
+
+	avatar := &model.Avatar{
+		EventID:    eventID,
+		Face:       face,
+		Source:     model.AvatarSourceUpload,
+		UploadedBy: uploaderName(c),
+		UploaderIP: c.ClientIP(),
+	}
+	if err := service.SaveAvatarVersion(avatar, ext, file.Size, src); err != nil {
+		if errors.Is(err, service.ErrQuotaExceeded) {
+			quotaError(c, err)
+			return
+		}
+		response.Error(c, 500, "Failed to save avatar")
+		return
+	}
 
 	response.Success(c, gin.H{
 		"message":  "Avatar uploaded",
-		"filename": baseName + ext,
+		"filename": avatar.Filename,
+		"version":  avatar.Version,
 	})
 }
 
+// uploaderName identifies who uploads an avatar: the email of signed-in
+// users, the session of participants, otherwise the user ID from the token
+func uploaderName(c *gin.Context) string {
+	userEmail, _ := c.Get("user_email")
+	if userEmailStr, _ := userEmail.(string); userEmailStr != "" {
+		return userEmailStr
+	}
+	if sessionID, _ := callerSession(c); sessionID != "" {
+		return sessionID
+	}
+	userID, _ := c.Get("user_id")
+	userIDStr, _ := userID.(string)
+	return userIDStr
+}
+
 // GET /api/events/:id/qq-profiles/:qq
 // Returns QQ nickname for a given QQ number
 func GetQQNickname(c *gin.Context) {
@@ -274,17 +455,28 @@ func UploadQQAvatar(c *gin.Context) {
 		return
 	}
 
+	if !authorizeFace(c, eventID, face) {
+		return
+	}
+
+	// Downloaded while the participant waits, so a size or quota refusal
+	// reaches them instead of only the activity log
+	err = service.DownloadQQAvatar(eventID, face, req.QQNumber, uploaderName(c), c.ClientIP())
+	if errors.Is(err, service.ErrAvatarTooLarge) || errors.Is(err, service.ErrQuotaExceeded) {
+		quotaError(c, err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to download QQ avatar: %v\n", err)
+		response.Error(c, 500, "Failed to download QQ avatar")
+		return
+	}
+
 	service.LogActivity("INFO", "图片处理", "上传QQ头像", "", strconv.Itoa(eventID), c.ClientIP(), map[string]any{
 		"face":      face,
 		"qq_number": req.QQNumber,
 	})
 
-	go func() {
-		if err := service.DownloadQQAvatar(eventID, face, req.QQNumber); err != nil {
-			fmt.Printf("Failed to download QQ avatar: %v\n", err)
-		}
-	}()
-
 	response.Success(c, gin.H{"message": "头像上传完成"})
 }
 
@@ -303,34 +495,28 @@ func GetFaceQQInfo(c *gin.Context) {
 		return
 	}
 
-	baseName := filename[:len(filename)-len(filepath.Ext(filename))]
-	jsonPath := storage.GetAvatarPath(eventID, baseName+".json")
-
-	data, err := os.ReadFile(jsonPath)
-	if os.IsNotExist(err) {
-		response.Success(c, gin.H{
-			"qq_number": nil,
-			"filename":  filename,
-		})
-		return
-	}
+	avatar, err := repository.GetAvatar(eventID, filename)
 	if err != nil {
 		response.Error(c, 500, "Failed to read QQ info")
 		return
 	}
-
-	var info map[string]any
-	if err := json.Unmarshal(data, &info); err != nil {
-		response.Error(c, 500, "Invalid QQ info format")
+	if avatar == nil || avatar.QQNumber == "" {
+		response.Success(c, gin.H{
+			"qq_number": nil,
+			"filename":  filename,
+		})
 		return
 	}
 
-	info["filename"] = filename
-	response.Success(c, info)
+	response.Success(c, gin.H{
+		"qq_number": avatar.QQNumber,
+		"filename":  filename,
+	})
 }
 
 // GET /api/events/:id/avatars/:filename
-// Returns an uploaded avatar image
+// Returns an uploaded avatar image. face_N.jpg or face_N.png, the names used
+// before avatars were versioned, return the current avatar of face_N.
 func GetUploadedAvatar(c *gin.Context) {
 	eventID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -344,14 +530,20 @@ func GetUploadedAvatar(c *gin.Context) {
 		return
 	}
 
-	avatarPath := storage.GetAvatarPath(eventID, filename)
-
-	if _, err := os.Stat(avatarPath); os.IsNotExist(err) {
-		response.Error(c, 404, "Avatar not found")
+	avatars, err := repository.GetAvatars(eventID)
+	if err != nil {
+		response.Error(c, 500, "Database error")
 		return
 	}
+	baseName := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, avatar := range avatars {
+		if strings.TrimSuffix(avatar.Face, filepath.Ext(avatar.Face)) == baseName {
+			filename = avatar.Filename
+			break
+		}
+	}
 
-	c.File(avatarPath)
+	serveObject(c, storage.AvatarKey(eventID, filename), "Avatar not found")
 }
 
 func DeleteFace(c *gin.Context) {
@@ -367,29 +559,40 @@ func DeleteFace(c *gin.Context) {
 		return
 	}
 
-	baseName := filename[:len(filename)-len(filepath.Ext(filename))]
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	avatars, err := repository.GetAvatarVersions(eventID, filename)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
 
 	// Delete face image
-	facePath := storage.GetFacePath(eventID, filename)
-	if err := os.Remove(facePath); err != nil && !os.IsNotExist(err) {
+	if err := storage.Delete(storage.FaceKey(eventID, filename)); err != nil {
 		response.Error(c, 500, "Failed to delete face image")
 		return
 	}
 
-	// Delete associated avatar (try all extensions)
-	for _, ext := range []string{".jpg", ".jpeg", ".png"} {
-		avatarPath := storage.GetAvatarPath(eventID, baseName+ext)
-		os.Remove(avatarPath)
+	// Delete associated avatar, every version of it
+	for _, avatar := range avatars {
+		if err := storage.Delete(storage.AvatarKey(eventID, avatar.Filename)); err != nil {
+			fmt.Printf("Warning: failed to delete avatar: %v\n", err)
+		}
+	}
+	if len(avatars) > 0 {
+		if err := repository.DeleteAvatar(eventID, filename); err != nil {
+			fmt.Printf("Warning: failed to delete avatar record: %v\n", err)
+		}
 	}
 
-	// Delete associated JSON
-	jsonPath := storage.GetAvatarPath(eventID, baseName+".json")
-	os.Remove(jsonPath)
-
-	// Update metadata.json
-	if err := removeFaceFromMetadata(eventID, filename); err != nil {
-		fmt.Printf("Warning: failed to update metadata: %v\n", err)
+	if _, err := repository.DeleteFaceClaim(eventID, filename); err != nil {
+		fmt.Printf("Warning: failed to delete face claim: %v\n", err)
+	}
+	if err := repository.DeleteFace(eventID, filename); err != nil {
+		fmt.Printf("Warning: failed to delete face record: %v\n", err)
 	}
+	service.InvalidateComposite(eventID)
 
 	userEmail, _ := c.Get("user_email")
 	userEmailStr, _ := userEmail.(string)
@@ -410,27 +613,13 @@ func GetEventPicInfo(c *gin.Context) {
 		return
 	}
 
-	metadataPath := storage.GetMetadataPath(eventID)
-
-	data, err := os.ReadFile(metadataPath)
-	if os.IsNotExist(err) {
-		response.Error(c, 404, "Metadata not found")
-		return
-	}
+	imageInfo, err := repository.GetEventPicture(eventID)
 	if err != nil {
 		response.Error(c, 500, "Failed to read metadata")
 		return
 	}
-
-	var metadata map[string]any
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		response.Error(c, 500, "Invalid metadata format")
-		return
-	}
-
-	imageInfo, ok := metadata["image_info"]
-	if !ok {
-		response.Error(c, 404, "Image info not found")
+	if imageInfo == nil {
+		response.Error(c, 404, "Metadata not found")
 		return
 	}
 
@@ -468,17 +657,8 @@ func AddManualFace(c *gin.Context) {
 	}
 
 	// Read original image
-	originalPath := storage.GetOriginalPath(eventID)
-	originalFile, err := os.Open(originalPath)
-	if err != nil {
-		response.Error(c, 404, "Original image not found")
-		return
-	}
-	defer originalFile.Close()
-
-	img, _, err := image.Decode(originalFile)
-	if err != nil {
-		response.Error(c, 500, "Failed to decode image")
+	img, ok := loadOriginal(c, eventID)
+	if !ok {
 		return
 	}
 
@@ -495,52 +675,41 @@ func AddManualFace(c *gin.Context) {
 	// Crop image
 	croppedImg := cropImage(img, x1, y1, x2, y2)
 
-	// Ensure directories exist
-	if err := storage.EnsureEventDirs(eventID); err != nil {
-		response.Error(c, 500, "Failed to create directories")
-		return
-	}
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
 
 	// Save cropped face
 	faceFilename := req.FaceID + ".jpg"
-	facePath := storage.GetFacePath(eventID, faceFilename)
-
-	faceFile, err := os.Create(facePath)
-	if err != nil {
-		response.Error(c, 500, "Failed to create face file")
-		return
-	}
-	defer faceFile.Close()
 
-	if err := jpeg.Encode(faceFile, croppedImg, &jpeg.Options{Quality: 90}); err != nil {
+	if err := saveJPEG(storage.FaceKey(eventID, faceFilename), croppedImg); err != nil {
 		response.Error(c, 500, "Failed to save face image")
 		return
 	}
 
-	// Update metadata.json
-	newFace := map[string]any{
-		"filename": faceFilename,
-		"coordinates": map[string]int{
-			"x1": x1,
-			"y1": y1,
-			"x2": x2,
-			"y2": y2,
+	newFace := model.Face{
+		Filename: faceFilename,
+		Coordinates: model.FaceCoordinate{
+			X1: x1,
+			Y1: y1,
+			X2: x2,
+			Y2: y2,
 		},
-		"confidence": 1.0,
-		"manual":     true,
-		"face_id":    req.FaceID,
+		Confidence: 1.0,
+		Manual:     true,
+		FaceID:     req.FaceID,
 	}
 
-	if err := addFaceToMetadata(eventID, imgW, imgH, newFace); err != nil {
-		fmt.Printf("Warning: failed to update metadata: %v\n", err)
+	if err := addFace(eventID, imgW, imgH, &newFace); err != nil {
+		fmt.Printf("Warning: failed to save face: %v\n", err)
 	}
+	service.InvalidateComposite(eventID)
 
 	userEmail, _ := c.Get("user_email")
 	userEmailStr, _ := userEmail.(string)
 
 	service.LogActivity("INFO", "图片处理", "手动添加人脸", userEmailStr, strconv.Itoa(eventID), c.ClientIP(), map[string]any{
 		"face_id":     req.FaceID,
-		"coordinates": newFace["coordinates"],
+		"coordinates": newFace.Coordinates,
 	})
 
 	response.Created(c, gin.H{
@@ -549,6 +718,101 @@ func AddManualFace(c *gin.Context) {
 	})
 }
 
+// PATCH /api/events/:id/faces/:filename
+// Moves or resizes a face box: re-crops the face image and updates metadata in
+// place, so the face keeps its avatar and QQ binding
+func UpdateFaceBox(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	filename := c.Param("filename")
+	if filepath.Base(filename) != filename {
+		response.Error(c, 400, "Invalid filename")
+		return
+	}
+
+	// Pointers so that 0 is accepted as a coordinate
+	var req struct {
+		X1 *int `json:"x1" binding:"required"`
+		Y1 *int `json:"y1" binding:"required"`
+		X2 *int `json:"x2" binding:"required"`
+		Y2 *int `json:"y2" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Error(c, 400, "Invalid request: "+err.Error())
+		return
+	}
+
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	face, err := repository.GetFace(eventID, filename)
+	if err != nil {
+		response.Error(c, 500, "Failed to read metadata")
+		return
+	}
+	if face == nil {
+		response.Error(c, 404, "Face not found")
+		return
+	}
+
+	// Read original image
+	img, ok := loadOriginal(c, eventID)
+	if !ok {
+		return
+	}
+
+	bounds := img.Bounds()
+	imgW, imgH := bounds.Max.X, bounds.Max.Y
+
+	// Clamp coordinates
+	x1 := clamp(*req.X1, 0, imgW)
+	y1 := clamp(*req.Y1, 0, imgH)
+	x2 := clamp(*req.X2, x1, imgW)
+	y2 := clamp(*req.Y2, y1, imgH)
+
+	if x2 == x1 || y2 == y1 {
+		response.Error(c, 400, "Face box is empty after clamping to the image")
+		return
+	}
+
+	// Re-crop the face
+	if err := saveJPEG(storage.FaceKey(eventID, filename), cropImage(img, x1, y1, x2, y2)); err != nil {
+		response.Error(c, 500, "Failed to save face image")
+		return
+	}
+
+	previous := face.Coordinates
+	face.Coordinates = model.FaceCoordinate{X1: x1, Y1: y1, X2: x2, Y2: y2}
+	// Landmarks only stay valid if the eyes are still inside the box
+	if face.Landmarks != nil && !eyesInside(face.Landmarks, face.Coordinates) {
+		face.Landmarks = nil
+	}
+	if err := repository.UpdateFace(eventID, face); err != nil {
+		response.Error(c, 500, "Failed to update metadata")
+		return
+	}
+	service.InvalidateComposite(eventID)
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "图片处理", "修改人脸区域", userEmailStr, strconv.Itoa(eventID), c.ClientIP(), map[string]any{
+		"face":     filename,
+		"previous": previous,
+		"current":  face.Coordinates,
+	})
+
+	response.Success(c, gin.H{
+		"message":   "Face updated",
+		"face_info": face,
+	})
+}
+
 func clamp(value, min, max int) int {
 	if value < min {
 		return min
@@ -579,78 +843,129 @@ func cropImage(img image.Image, x1, y1, x2, y2 int) image.Image {
 	return cropped
 }
 
-func addFaceToMetadata(eventID, imgW, imgH int, newFace map[string]any) error {
-	metadataPath := storage.GetMetadataPath(eventID)
-
-	var metadata map[string]any
-
-	data, err := os.ReadFile(metadataPath)
-	if os.IsNotExist(err) {
-		// Create new metadata
-		metadata = map[string]any{
-			"image_info": map[string]any{
-				"width":    imgW,
-				"height":   imgH,
-				"filename": "original.jpg",
-			},
-			"faces": []any{},
-		}
-	} else if err != nil {
-		return err
-	} else {
-		if err := json.Unmarshal(data, &metadata); err != nil {
-			return err
+// serveObject sends a stored file, or redirects to a presigned URL when the
+// storage backend supports them
+func serveObject(c *gin.Context, key, notFoundMessage string) {
+	backend, err := storage.Default()
+	if err != nil {
+		response.Error(c, 500, "Storage unavailable")
+		return
+	}
+
+	info, err := backend.Stat(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		response.Error(c, 404, notFoundMessage)
+		return
+	}
+	if err != nil {
+		response.Error(c, 500, "Failed to read file")
+		return
+	}
+
+	if presigner, ok := backend.(storage.Presigner); ok {
+		if ttl := config.Current().S3PresignTTLSeconds; ttl > 0 {
+			url, err := presigner.PresignGet(key, time.Duration(ttl)*time.Second)
+			if err == nil {
+				c.Redirect(302, url)
+				return
+			}
+			fmt.Printf("Warning: failed to presign %s: %v\n", key, err)
 		}
 	}
 
-	// Append new face
-	faces, ok := metadata["faces"].([]any)
-	if !ok {
-		faces = []any{}
+	r, err := backend.Get(key)
+	if err != nil {
+		response.Error(c, 500, "Failed to read file")
+		return
 	}
-	metadata["faces"] = append(faces, newFace)
+	defer r.Close()
 
-	// Write back
-	updated, err := json.MarshalIndent(metadata, "", "    ")
+	// Local files support range and conditional requests
+	if rs, ok := r.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, path.Base(key), info.ModTime, rs)
+		return
+	}
+	c.DataFromReader(200, info.Size, mime.TypeByExtension(path.Ext(key)), r, nil)
+}
+
+// loadOriginal decodes the event picture, replying with an error if it can't
+func loadOriginal(c *gin.Context, eventID int) (image.Image, bool) {
+	r, err := storage.Get(storage.OriginalKey(eventID))
+	if errors.Is(err, storage.ErrNotFound) {
+		response.Error(c, 404, "Original image not found")
+		return nil, false
+	}
 	if err != nil {
-		return err
+		response.Error(c, 500, "Failed to read image")
+		return nil, false
 	}
+	defer r.Close()
 
-	return os.WriteFile(metadataPath, updated, 0644)
+	img, _, err := image.Decode(r)
+	if err != nil {
+		response.Error(c, 500, "Failed to decode image")
+		return nil, false
+	}
+	return img, true
 }
 
-func removeFaceFromMetadata(eventID int, filename string) error {
-	metadataPath := storage.GetMetadataPath(eventID)
+// saveJPEG stores a face crop
+func saveJPEG(key string, img image.Image) error {
+	return storage.Write(key, func(w io.Writer) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	})
+}
 
-	data, err := os.ReadFile(metadataPath)
-	if os.IsNotExist(err) {
-		return nil
+// quotaError answers an upload refused by a size limit or quota: 413 for an
+// oversized avatar, 507 for a full quota, 500 when the check itself failed
+func quotaError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrAvatarTooLarge):
+		response.Error(c, 413, err.Error())
+	case errors.Is(err, service.ErrQuotaExceeded):
+		response.Error(c, 507, err.Error())
+	default:
+		fmt.Printf("Warning: quota check failed: %v\n", err)
+		response.Error(c, 500, "Failed to check storage quota")
 	}
+}
+
+// saveUploadedFile is c.SaveUploadedFile for the storage backend
+func saveUploadedFile(file *multipart.FileHeader, key string) error {
+	src, err := file.Open()
 	if err != nil {
 		return err
 	}
+	defer src.Close()
+
+	return storage.Put(key, src)
+}
 
-	var metadata map[string]any
-	if err := json.Unmarshal(data, &metadata); err != nil {
+// addFace stores a manually added face, recording the picture size first if
+// the picture has never been through detection
+func addFace(eventID, imgW, imgH int, face *model.Face) error {
+	info, err := repository.GetEventPicture(eventID)
+	if err != nil {
 		return err
 	}
-
-	if faces, ok := metadata["faces"].([]any); ok {
-		var filtered []any
-		for _, f := range faces {
-			if face, ok := f.(map[string]any); ok {
-				if face["filename"] != filename {
-					filtered = append(filtered, face)
-				}
-			}
+	if info == nil {
+		if err := repository.UpdateEventPicture(eventID, imgW, imgH); err != nil {
+			return err
 		}
-		metadata["faces"] = filtered
 	}
 
-	updated, err := json.MarshalIndent(metadata, "", "    ")
-	if err != nil {
+	// Re-adding a face id replaces the earlier box
+	if err := repository.DeleteFace(eventID, face.Filename); err != nil {
 		return err
 	}
+	return repository.CreateFace(eventID, face)
+}
 
-	return os.WriteFile(metadataPath, updated, 0644)
+func eyesInside(landmarks *model.FaceLandmarks, box model.FaceCoordinate) bool {
+	for _, eye := range []model.FacePoint{landmarks.LeftEye, landmarks.RightEye} {
+		if eye.X < box.X1 || eye.X >= box.X2 || eye.Y < box.Y1 || eye.Y >= box.Y2 {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,392 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestUploadPictureDetectsSidecarFaces uploads an event picture and lets the
+// detection worker run the mock detector on the faces listed in its sidecar
+func TestUploadPictureDetectsSidecarFaces(t *testing.T) {
+	eventID := createTestEvent(t, 80, 60)
+	router := testRouter()
+
+	// The second face reaches the picture corner, so its padding is clamped
+	sidecar := `[{"x":30,"y":40,"width":60,"height":70},{"x":300,"y":200,"width":90,"height":90}]`
+	if err := storage.Put(storage.OriginalKey(eventID)+".faces.json", strings.NewReader(sidecar)); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadPicture(t, router, eventID, testPicture(t, 400, 300))
+	status := waitForDetection(t, router, eventID)
+	if status.Status != model.JobSucceeded || status.FacesCount == nil || *status.FacesCount != 2 {
+		t.Fatalf("detection ended %s with %v faces: %s", status.Status, status.FacesCount, status.Error)
+	}
+
+	w := serve(router, http.MethodGet, fmt.Sprintf("/events/%d/faces", eventID), "")
+	var list struct {
+		Faces []string `json:"faces"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("faces: %d %s", w.Code, w.Body)
+	}
+	if strings.Join(list.Faces, ",") != "face_1.jpg,face_2.jpg" {
+		t.Fatalf("faces = %v, want face_1.jpg and face_2.jpg", list.Faces)
+	}
+
+	w = serve(router, http.MethodGet, fmt.Sprintf("/events/%d/faces/metadata", eventID), "")
+	var metadata struct {
+		ImageInfo model.ImageInfo `json:"image_info"`
+		Faces     []model.Face    `json:"faces"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil {
+		t.Fatalf("metadata: %d %s", w.Code, w.Body)
+	}
+	if metadata.ImageInfo.Width != 400 || metadata.ImageInfo.Height != 300 {
+		t.Errorf("picture size %dx%d, want 400x300", metadata.ImageInfo.Width, metadata.ImageInfo.Height)
+	}
+
+	// Sidecar boxes plus the default 10px padding
+	want := map[string]model.FaceCoordinate{
+		"face_1.jpg": {X1: 20, Y1: 30, X2: 100, Y2: 120},
+		"face_2.jpg": {X1: 290, Y1: 190, X2: 400, Y2: 300},
+	}
+	if len(metadata.Faces) != len(want) {
+		t.Fatalf("metadata has %d faces, want %d", len(metadata.Faces), len(want))
+	}
+	for _, face := range metadata.Faces {
+		box := want[face.Filename]
+		if face.Coordinates != box {
+			t.Errorf("%s at %+v, want %+v", face.Filename, face.Coordinates, box)
+		}
+		if face.Manual {
+			t.Errorf("%s is marked manual", face.Filename)
+		}
+
+		// The crop has the box's size and shows the picture under the box
+		w := serve(router, http.MethodGet, fmt.Sprintf("/events/%d/faces/%s", eventID, face.Filename), "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("crop %s: %d %s", face.Filename, w.Code, w.Body)
+		}
+		crop, err := jpeg.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("crop %s: %v", face.Filename, err)
+		}
+		size := crop.Bounds().Size()
+		if size != (image.Point{X: box.X2 - box.X1, Y: box.Y2 - box.Y1}) {
+			t.Errorf("crop %s is %v, want the box size", face.Filename, size)
+			continue
+		}
+		cx, cy := size.X/2, size.Y/2
+		r, g, _, _ := crop.At(crop.Bounds().Min.X+cx, crop.Bounds().Min.Y+cy).RGBA()
+		expected := testColor(box.X1+cx, box.Y1+cy)
+		if diff(r>>8, expected.R) > 6 || diff(g>>8, expected.G) > 6 {
+			t.Errorf("crop %s centre is (%d,%d), want about (%d,%d)", face.Filename, r>>8, g>>8, expected.R, expected.G)
+		}
+	}
+}
+
+// A picture that cannot be decoded will not decode on a retry either
+func TestUndecodablePictureFailsWithoutRetry(t *testing.T) {
+	eventID := createTestEvent(t, 80, 60)
+	router := testRouter()
+
+	uploadPicture(t, router, eventID, []byte("not a picture"))
+	status := waitForDetection(t, router, eventID)
+	if status.Status != model.JobFailed || status.Attempts != 1 {
+		t.Fatalf("detection ended %s after %d attempts, want failed after 1", status.Status, status.Attempts)
+	}
+	if !strings.Contains(status.Error, service.ErrImageUndecodable.Error()) {
+		t.Errorf("error = %q", status.Error)
+	}
+}
+
+// A new picture shows other people under the same face names, so nothing
+// tied to the faces of the previous one may carry over
+func TestReplacedPictureDropsClaimsAndAvatars(t *testing.T) {
+	eventID := createTestEvent(t, 80, 60)
+	router := testRouter()
+
+	sidecar := `[{"x":30,"y":40,"width":60,"height":70}]`
+	if err := storage.Put(storage.OriginalKey(eventID)+".faces.json", strings.NewReader(sidecar)); err != nil {
+		t.Fatal(err)
+	}
+	uploadPicture(t, router, eventID, testPicture(t, 200, 150))
+	if status := waitForDetection(t, router, eventID); status.Status != model.JobSucceeded {
+		t.Fatalf("detection ended %s: %s", status.Status, status.Error)
+	}
+
+	if ok, err := repository.CreateFaceClaim(eventID, "face_1.jpg", "session-1"); err != nil || !ok {
+		t.Fatalf("claim: %v %v", ok, err)
+	}
+	avatar := &model.Avatar{EventID: eventID, Face: "face_1.jpg", Source: "upload"}
+	if err := service.SaveAvatarVersion(avatar, ".png", 3, strings.NewReader("png")); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadPicture(t, router, eventID, testPicture(t, 240, 180))
+	if status := waitForDetection(t, router, eventID); status.Status != model.JobSucceeded {
+		t.Fatalf("detection ended %s: %s", status.Status, status.Error)
+	}
+
+	claim, err := repository.GetFaceClaim(eventID, "face_1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim != nil {
+		t.Errorf("face_1.jpg is still claimed by %s", claim.SessionID)
+	}
+	current, err := repository.GetAvatar(eventID, "face_1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != nil {
+		t.Errorf("face_1.jpg still has avatar %s", current.Filename)
+	}
+	if storage.Exists(storage.AvatarKey(eventID, avatar.Filename)) {
+		t.Errorf("avatar file %s was not set aside", avatar.Filename)
+	}
+}
+
+// Tencent errors such as bad credentials fail the same way on every attempt,
+// while throttling is worth another try
+func TestPermanentTencentErrorFailsWithoutRetry(t *testing.T) {
+	router := testRouter()
+	for code, permanent := range map[string]bool{
+		"AuthFailure.SecretIdNotFound":         true,
+		"InvalidParameterValue.ImageEmpty":     true,
+		"FailedOperation.RequestLimitExceeded": false,
+	} {
+		eventID := createTestEvent(t, 80, 60)
+		sidecar := fmt.Sprintf(`{"tencent_error":%q}`, code)
+		if err := storage.Put(storage.OriginalKey(eventID)+".faces.json", strings.NewReader(sidecar)); err != nil {
+			t.Fatal(err)
+		}
+		uploadPicture(t, router, eventID, testPicture(t, 80, 60))
+
+		if !permanent {
+			status := waitForRetry(t, router, eventID)
+			if status.Attempts != 1 || status.RetryAt == "" || !strings.Contains(status.Error, code) {
+				t.Errorf("%s: job %s after %d attempts, retry at %q: %s", code, status.Status, status.Attempts, status.RetryAt, status.Error)
+			}
+			continue
+		}
+		status := waitForDetection(t, router, eventID)
+		if status.Status != model.JobFailed || status.Attempts != 1 {
+			t.Errorf("%s: detection ended %s after %d attempts, want failed after 1", code, status.Status, status.Attempts)
+		}
+		if !strings.Contains(status.Error, service.ErrTencentPermanent.Error()) || !strings.Contains(status.Error, code) {
+			t.Errorf("%s: error = %q", code, status.Error)
+		}
+	}
+}
+
+// uploadPicture uploads data as the event picture, which queues detection
+func uploadPicture(t *testing.T, router *gin.Engine, eventID int, data []byte) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "group.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/events/%d/picture", eventID), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+}
+
+type jobStatus struct {
+	Status     string `json:"status"`
+	Attempts   int    `json:"attempts"`
+	FacesCount *int   `json:"faces_count"`
+	Error      string `json:"error"`
+	RetryAt    string `json:"retry_at"`
+}
+
+func (s jobStatus) finished() bool {
+	return s.Status == model.JobSucceeded || s.Status == model.JobFailed
+}
+
+// waitForDetection polls the status endpoint until the event's detection job
+// has finished
+func waitForDetection(t *testing.T, router *gin.Engine, eventID int) jobStatus {
+	t.Helper()
+	return waitForJob(t, router, eventID, jobStatus.finished)
+}
+
+// waitForRetry polls the status endpoint until the event's detection job has
+// failed once and waits for another attempt, or has finished
+func waitForRetry(t *testing.T, router *gin.Engine, eventID int) jobStatus {
+	t.Helper()
+	return waitForJob(t, router, eventID, func(s jobStatus) bool {
+		return s.RetryAt != "" || s.finished()
+	})
+}
+
+func waitForJob(t *testing.T, router *gin.Engine, eventID int, done func(jobStatus) bool) jobStatus {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		var status jobStatus
+		w := serve(router, http.MethodGet, fmt.Sprintf("/events/%d/status", eventID), "")
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("status: %d %s", w.Code, w.Body)
+		}
+		if done(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("detection still %s after 10s", status.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func diff(a uint32, b uint8) uint32 {
+	if a > uint32(b) {
+		return a - uint32(b)
+	}
+	return uint32(b) - a
+}
+
+// TestConcurrentFaceEditsKeepEveryFace edits the faces of one event from
+// several requests at once while detection re-runs, then checks that no face
+// or avatar was lost to an interleaved read-modify-write
+func TestConcurrentFaceEditsKeepEveryFace(t *testing.T) {
+	eventID := createTestEvent(t, 640, 240)
+	router := testRouter()
+
+	// Three detected faces on the top row, manual faces go below them
+	sidecar := `[{"x":40,"y":40,"width":80,"height":80},` +
+		`{"x":260,"y":40,"width":80,"height":80},` +
+		`{"x":480,"y":40,"width":80,"height":80}]`
+	if err := storage.Put(storage.OriginalKey(eventID)+".faces.json", strings.NewReader(sidecar)); err != nil {
+		t.Fatal(err)
+	}
+	padding := 0
+	settings := model.DetectionSettings{Padding: &padding}
+	if _, err := service.ProcessEventImage(&service.MockDetector{}, eventID, settings); err != nil {
+		t.Fatal(err)
+	}
+
+	detected := []string{"face_1.jpg", "face_2.jpg", "face_3.jpg"}
+	for _, face := range detected {
+		avatar := &model.Avatar{EventID: eventID, Face: face, Source: "upload"}
+		if err := service.SaveAvatarVersion(avatar, ".png", 3, strings.NewReader("png")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const n = 6
+	for i := range n {
+		body := fmt.Sprintf(`{"x1":%d,"y1":150,"x2":%d,"y2":230,"face_id":"d%d"}`, 10+i*100, 90+i*100, i)
+		if w := serve(router, http.MethodPost, fmt.Sprintf("/events/%d/faces", eventID), body); w.Code != http.StatusCreated {
+			t.Fatalf("add d%d: %d %s", i, w.Code, w.Body)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 4*n)
+	for i := range n {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"x1":%d,"y1":150,"x2":%d,"y2":230,"face_id":"m%d"}`, 20+i*100, 80+i*100, i)
+			if w := serve(router, http.MethodPost, fmt.Sprintf("/events/%d/faces", eventID), body); w.Code != http.StatusCreated {
+				errs <- fmt.Sprintf("add m%d: %d %s", i, w.Code, w.Body)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if w := serve(router, http.MethodDelete, fmt.Sprintf("/events/%d/faces/d%d.jpg", eventID, i), ""); w.Code != http.StatusOK {
+				errs <- fmt.Sprintf("delete d%d: %d %s", i, w.Code, w.Body)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			x := []int{40, 260, 480}[i%3] + i%2 + 1
+			body := fmt.Sprintf(`{"x1":%d,"y1":41,"x2":%d,"y2":121}`, x, x+80)
+			if w := serve(router, http.MethodPatch, fmt.Sprintf("/events/%d/faces/%s", eventID, detected[i%3]), body); w.Code != http.StatusOK {
+				errs <- fmt.Sprintf("update %s: %d %s", detected[i%3], w.Code, w.Body)
+			}
+		}()
+	}
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := service.ReprocessEventImage(&service.MockDetector{}, eventID, settings); err != nil {
+				errs <- fmt.Sprintf("reprocess: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	faces, err := repository.GetFaces(eventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, face := range faces {
+		got[face.Filename] = true
+		if !storage.Exists(storage.FaceKey(eventID, face.Filename)) {
+			t.Errorf("face %s has no crop", face.Filename)
+		}
+	}
+	want := append([]string{}, detected...)
+	for i := range n {
+		want = append(want, fmt.Sprintf("m%d.jpg", i))
+		if got[fmt.Sprintf("d%d.jpg", i)] {
+			t.Errorf("deleted face d%d.jpg is back", i)
+		}
+	}
+	for _, name := range want {
+		if !got[name] {
+			t.Errorf("face %s was lost", name)
+		}
+	}
+	if len(faces) != len(want) {
+		t.Errorf("%d faces, want %d", len(faces), len(want))
+	}
+
+	for _, face := range detected {
+		avatar, err := repository.GetAvatar(eventID, face)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if avatar == nil {
+			t.Errorf("avatar of %s was lost", face)
+			continue
+		}
+		if !storage.Exists(storage.AvatarKey(eventID, avatar.Filename)) {
+			t.Errorf("avatar file %s of %s is missing", avatar.Filename, face)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/pkg/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/gc/orphans
+// Dry run: lists orphaned files without deleting anything
+func ListOrphans(c *gin.Context) {
+	runGC(c, true)
+}
+
+// POST /api/gc
+// Deletes orphaned files; the body must be {"confirm": true}
+func CollectGarbage(c *gin.Context) {
+	var req struct {
+		Confirm bool `json:"confirm"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !req.Confirm {
+		response.Error(c, 400, `Deleting orphaned files requires {"confirm": true}; use GET /api/gc/orphans for a dry run`)
+		return
+	}
+	runGC(c, false)
+}
+
+// runGC runs the collector; ?min_age_hours overrides GC_MIN_AGE_HOURS
+func runGC(c *gin.Context, dryRun bool) {
+	minAgeHours := config.Current().GCMinAgeHours
+	if v := c.Query("min_age_hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			response.Error(c, 400, "Invalid min_age_hours")
+			return
+		}
+		minAgeHours = n
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	report, err := service.CollectGarbage(dryRun, time.Duration(minAgeHours)*time.Hour, userEmailStr, c.ClientIP())
+	if err != nil {
+		fmt.Printf("Warning: garbage collection failed: %v\n", err)
+		response.Error(c, 500, "Failed to collect orphaned files")
+		return
+	}
+
+	response.Success(c, report)
+}
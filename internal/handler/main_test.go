@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/database"
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMain runs the handlers against a temporary database and local storage,
+// with detection workers using the offline mock face detector
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "handler-test-")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Setenv("STORAGE_BACKEND", storage.BackendLocal)
+	os.Setenv("STORAGE_DIR", filepath.Join(dir, "storage"))
+	os.Setenv("FACE_DETECTOR", "mock")
+	cfg := config.Load()
+	if err := storage.Init(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err := database.Init(filepath.Join(dir, "app.db")); err != nil {
+		log.Fatal(err)
+	}
+	if err := service.StartDetectionWorkers(cfg); err != nil {
+		log.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+
+	code := m.Run()
+	database.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createTestEvent creates an event with a width x height picture
+func createTestEvent(t *testing.T, width, height int) int {
+	t.Helper()
+	id, err := repository.CreateEvent(&model.CreateEventRequest{
+		Description: t.Name(),
+		Token:       fmt.Sprintf("token-%s", t.Name()),
+		EventDate:   "2024-01-01",
+		IsOpen:      true,
+	}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Put(storage.OriginalKey(int(id)), bytes.NewReader(testPicture(t, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+// testPicture encodes a JPEG whose pixel at (x, y) is testColor(x, y), so a
+// crop can be traced back to where it was taken from
+func testPicture(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, testColor(x, y))
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testColor(x, y int) color.RGBA {
+	return color.RGBA{uint8(x / 2), uint8(y / 2), 128, 255}
+}
+
+// testRouter mounts the handlers under test without authentication
+func testRouter() *gin.Engine {
+	r := gin.New()
+	r.PUT("/events/:id/picture", UploadEventPic)
+	r.GET("/events/:id/status", GetProcessStatus)
+	r.GET("/events/:id/faces", GetEventFaces)
+	r.GET("/events/:id/faces/metadata", GetEventMetadata)
+	r.GET("/events/:id/faces/:filename", GetFaceImage)
+	r.POST("/events/:id/faces", AddManualFace)
+	r.PATCH("/events/:id/faces/:filename", UpdateFaceBox)
+	r.DELETE("/events/:id/faces/:filename", DeleteFace)
+	return r
+}
+
+// serve sends a JSON request through router and returns the recorder
+func serve(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/pkg/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trashedEvent is a trashed event with the time it will be purged
+type trashedEvent struct {
+	model.Event
+	PurgeAt string `json:"purge_at,omitempty"` // empty when kept until purged by hand
+}
+
+func ListTrashedEvents(c *gin.Context) {
+	events, err := repository.GetTrashedEvents()
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+
+	retention := config.Current().TrashRetentionDays
+	trashed := make([]trashedEvent, 0, len(events))
+	for _, e := range events {
+		item := trashedEvent{Event: e}
+		if t := service.TrashPurgeTime(e.DeletedAt, retention); !t.IsZero() {
+			item.PurgeAt = t.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		trashed = append(trashed, item)
+	}
+
+	response.Success(c, gin.H{"events": trashed, "retention_days": retention})
+}
+
+func RestoreEvent(c *gin.Context) {
+	idStr := c.Param("id")
+	id, ok := trashedEventID(c)
+	if !ok {
+		return
+	}
+
+	if err := service.RestoreEvent(id); err != nil {
+		fmt.Printf("Warning: failed to restore event %d: %v\n", id, err)
+		response.Error(c, 500, "Failed to restore event")
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("INFO", "活动管理", "恢复活动", userEmailStr, idStr, c.ClientIP(), nil)
+
+	response.Success(c, gin.H{"message": "Event restored"})
+}
+
+func PurgeEvent(c *gin.Context) {
+	idStr := c.Param("id")
+	id, ok := trashedEventID(c)
+	if !ok {
+		return
+	}
+
+	if err := service.PurgeEvent(id); err != nil {
+		fmt.Printf("Warning: failed to purge event %d: %v\n", id, err)
+		response.Error(c, 500, "Failed to purge event")
+		return
+	}
+
+	userEmail, _ := c.Get("user_email")
+	userEmailStr, _ := userEmail.(string)
+
+	service.LogActivity("WARNING", "活动管理", "彻底删除活动", userEmailStr, idStr, c.ClientIP(), nil)
+
+	response.Success(c, gin.H{"message": "Event purged"})
+}
+
+// trashedEventID parses the event ID and checks the event is in the trash,
+// writing the error response otherwise
+func trashedEventID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return 0, false
+	}
+
+	event, err := repository.GetTrashedEvent(id)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return 0, false
+	}
+	if event == nil {
+		response.Error(c, 404, "Event not found in trash")
+		return 0, false
+	}
+	return id, true
+}
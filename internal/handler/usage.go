@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/service"
+	"avatar-face-swap-go/pkg/response"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/usage
+// Disk usage of every event, largest first, with the configured quotas
+func GetUsageReport(c *gin.Context) {
+	report, err := service.GetUsageReport()
+	if err != nil {
+		fmt.Printf("Warning: failed to compute storage usage: %v\n", err)
+		response.Error(c, 500, "Failed to compute storage usage")
+		return
+	}
+
+	response.Success(c, report)
+}
+
+// GET /api/events/:id/usage
+func GetEventUsage(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Error(c, 400, "Invalid event ID")
+		return
+	}
+
+	event, err := repository.GetEventByID(eventID)
+	if err != nil {
+		response.Error(c, 500, "Database error")
+		return
+	}
+	if event == nil {
+		response.Error(c, 404, "Event not found")
+		return
+	}
+
+	usage, err := service.GetEventUsage(eventID)
+	if err != nil {
+		fmt.Printf("Warning: failed to compute storage usage of event %d: %v\n", eventID, err)
+		response.Error(c, 500, "Failed to compute storage usage")
+		return
+	}
+
+	response.Success(c, usage)
+}
@@ -36,6 +36,7 @@ func AuthRequired() gin.HandlerFunc {
 		c.Set("user_id", claims.UserID)
 		c.Set("role", claims.Role)
 		c.Set("user_email", claims.UserEmail)
+		c.Set("session_id", claims.SessionID)
 
 		c.Next()
 	}
@@ -0,0 +1,35 @@
+package model
+
+import "encoding/json"
+
+// Detection job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Detection job modes
+const (
+	// JobModeReplace detects faces from scratch, as after a new upload
+	JobModeReplace = "replace"
+	// JobModeMerge re-runs detection but keeps manual faces and moves avatars
+	// to the matching new faces
+	JobModeMerge = "merge"
+)
+
+type DetectionJob struct {
+	ID         int64           `json:"job_id"`
+	EventID    int             `json:"event_id"`
+	Status     string          `json:"status"`
+	Mode       string          `json:"mode"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error,omitempty"`
+	RetryAt    string          `json:"retry_at,omitempty"` // earliest next attempt of a requeued job
+	FacesCount *int            `json:"faces_count,omitempty"`
+	Report     json.RawMessage `json:"report,omitempty"` // what a merge run changed
+	CreatedAt  string          `json:"created_at"`
+	StartedAt  string          `json:"started_at,omitempty"`
+	FinishedAt string          `json:"finished_at,omitempty"`
+}
@@ -7,6 +7,32 @@ type Event struct {
 	EventDate   string `json:"event_date"`
 	IsOpen      bool   `json:"is_open"`
 	Creator     string `json:"creator,omitempty"`
+
+	Composite CompositeSettings `json:"composite"`
+	Detection DetectionSettings `json:"detection"`
+
+	DeletedAt string `json:"deleted_at,omitempty"` // set while the event is in the trash
+}
+
+// CompositeSettings controls how avatars are pasted into the group photo
+type CompositeSettings struct {
+	MaskShape  string `json:"mask_shape"`  // rectangle, rounded, circle, ellipse
+	Feather    int    `json:"feather"`     // alpha falloff radius in pixels
+	Align      string `json:"align"`       // box, landmarks
+	ColorMatch string `json:"color_match"` // none, mean_std, histogram
+	Blend      string `json:"blend"`       // alpha, seamless
+}
+
+// DetectionSettings tune face detection for one event
+type DetectionSettings struct {
+	MaxFaceNum   int    `json:"max_face_num"`  // faces per detection call
+	MinFaceSize  int    `json:"min_face_size"` // smallest face edge in pixels
+	ModelVersion string `json:"model_version"` // Tencent face model: 2.0, 3.0
+	Padding      *int   `json:"padding"`       // margin added around each face crop
+	PaddingUnit  string `json:"padding_unit"`  // px, percent (of the face width/height)
+
+	MinQuality     int  `json:"min_quality"`      // faces scoring below are flagged low_quality, 0 disables
+	HideLowQuality bool `json:"hide_low_quality"` // also hide flagged faces from participants
 }
 
 type CreateEventRequest struct {
@@ -21,4 +47,7 @@ type UpdateEventRequest struct {
 	Token       *string `json:"token"`
 	EventDate   *string `json:"event_date"`
 	IsOpen      *bool   `json:"is_open"`
+
+	Composite *CompositeSettings `json:"composite"`
+	Detection *DetectionSettings `json:"detection"`
 }
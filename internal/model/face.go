@@ -0,0 +1,97 @@
+package model
+
+// ImageInfo describes the event picture the faces were found in
+type ImageInfo struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Filename string `json:"filename"`
+}
+
+// Face is a face box in the event picture, detected or added by an admin
+type Face struct {
+	Filename    string         `json:"filename"`
+	Coordinates FaceCoordinate `json:"coordinates"`
+	Confidence  float64        `json:"confidence,omitempty"`
+	Landmarks   *FaceLandmarks `json:"landmarks,omitempty"`
+	Pose        *FacePose      `json:"pose,omitempty"`
+	Quality     *FaceQuality   `json:"quality,omitempty"`
+	Manual      bool           `json:"manual,omitempty"`  // added by an admin via AddManualFace
+	FaceID      string         `json:"face_id,omitempty"` // id of a manual face
+}
+
+type FaceCoordinate struct {
+	X1 int `json:"x1"`
+	Y1 int `json:"y1"`
+	X2 int `json:"x2"`
+	Y2 int `json:"y2"`
+}
+
+// FacePoint is a pixel position in the original image
+type FacePoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// FaceLandmarks holds the centre of each facial feature in original image coordinates
+type FaceLandmarks struct {
+	LeftEye  FacePoint `json:"left_eye"`
+	RightEye FacePoint `json:"right_eye"`
+	Nose     FacePoint `json:"nose"`
+	Mouth    FacePoint `json:"mouth"`
+}
+
+// FacePose is the head orientation in degrees as reported by Tencent
+type FacePose struct {
+	Roll  int `json:"roll"`
+	Yaw   int `json:"yaw"`
+	Pitch int `json:"pitch"`
+}
+
+// FaceQuality is Tencent's quality assessment; every score is in [0,100].
+// Score is the overall rating, the others are for reference.
+type FaceQuality struct {
+	Score        int               `json:"score"`
+	Sharpness    int               `json:"sharpness"`
+	Brightness   int               `json:"brightness"`
+	Completeness *FaceCompleteness `json:"completeness,omitempty"`
+}
+
+// FaceCompleteness rates how unobstructed each facial feature is
+type FaceCompleteness struct {
+	Eyebrow int `json:"eyebrow"`
+	Eye     int `json:"eye"`
+	Nose    int `json:"nose"`
+	Cheek   int `json:"cheek"`
+	Mouth   int `json:"mouth"`
+	Chin    int `json:"chin"`
+}
+
+// Avatar sources
+const (
+	AvatarSourceUpload = "upload"
+	AvatarSourceQQ     = "qq"
+)
+
+// Avatar is the image chosen to replace a face in the composite
+type Avatar struct {
+	ID        int64  `json:"id"`
+	EventID   int    `json:"event_id"`
+	Face      string `json:"face"`     // face filename, e.g. face_1.jpg
+	Filename  string `json:"filename"` // file in the event's avatars directory
+	Source    string `json:"source"`   // upload, qq
+	QQNumber  string `json:"qq_number,omitempty"`
+	CreatedAt string `json:"created_at"`
+
+	Version    int    `json:"version"` // numbered per face, starting at 1
+	Current    bool   `json:"current"` // exactly one version of a face is current
+	UploadedBy string `json:"uploaded_by,omitempty"`
+	UploaderIP string `json:"uploader_ip,omitempty"`
+}
+
+// FaceClaim ties a face to the participant session allowed to change its avatar
+type FaceClaim struct {
+	EventID   int    `json:"event_id"`
+	Face      string `json:"face"`
+	SessionID string `json:"session_id"`
+	ClaimedAt string `json:"claimed_at"`
+}
@@ -6,15 +6,18 @@ type JWTClaims struct {
 	UserID    string `json:"sub"`
 	Role      string `json:"role"`
 	UserEmail string `json:"user_email,omitempty"`
+	SessionID string `json:"sid,omitempty"` // participant session, set for event token logins
 	jwt.RegisteredClaims
 }
 
 type LoginRequest struct {
-	Token string `json:"token" binding:"required"`
+	Token     string `json:"token" binding:"required"`
+	SessionID string `json:"session_id"` // resume a participant session, keeping its face claim
 }
 
 type LoginResponse struct {
 	EventID     string `json:"event_id"`
 	Description string `json:"description,omitempty"`
 	Token       string `json:"token"`
+	SessionID   string `json:"session_id,omitempty"`
 }
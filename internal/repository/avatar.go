@@ -0,0 +1,226 @@
+package repository
+
+import (
+	"database/sql"
+
+	"avatar-face-swap-go/internal/database"
+	"avatar-face-swap-go/internal/model"
+)
+
+const avatarColumns = `id, event_id, face, filename, source, qq_number, created_at, version, is_current, uploaded_by, uploader_ip`
+
+func scanAvatar(row interface{ Scan(...any) error }) (*model.Avatar, error) {
+	var avatar model.Avatar
+	var qqNumber, uploadedBy, uploaderIP sql.NullString
+
+	err := row.Scan(
+		&avatar.ID,
+		&avatar.EventID,
+		&avatar.Face,
+		&avatar.Filename,
+		&avatar.Source,
+		&qqNumber,
+		&avatar.CreatedAt,
+		&avatar.Version,
+		&avatar.Current,
+		&uploadedBy,
+		&uploaderIP,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	avatar.QQNumber = qqNumber.String
+	avatar.UploadedBy = uploadedBy.String
+	avatar.UploaderIP = uploaderIP.String
+	return &avatar, nil
+}
+
+func queryAvatars(query string, args ...any) ([]model.Avatar, error) {
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	avatars := []model.Avatar{}
+	for rows.Next() {
+		avatar, err := scanAvatar(rows)
+		if err != nil {
+			return nil, err
+		}
+		avatars = append(avatars, *avatar)
+	}
+
+	return avatars, rows.Err()
+}
+
+// GetAvatar returns the current avatar of a face, or nil if none was uploaded
+func GetAvatar(eventID int, face string) (*model.Avatar, error) {
+	query := `SELECT ` + avatarColumns + ` FROM avatar WHERE event_id = ? AND face = ? AND is_current = 1`
+
+	avatar, err := scanAvatar(database.DB.QueryRow(query, eventID, face))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return avatar, err
+}
+
+// GetAvatars returns the current avatar of every face of an event
+func GetAvatars(eventID int) ([]model.Avatar, error) {
+	return queryAvatars(`SELECT `+avatarColumns+` FROM avatar WHERE event_id = ? AND is_current = 1 ORDER BY id`, eventID)
+}
+
+// GetAvatarVersion returns one version of the avatar of a face, or nil if
+// there is no such version
+func GetAvatarVersion(eventID int, face string, version int) (*model.Avatar, error) {
+	query := `SELECT ` + avatarColumns + ` FROM avatar WHERE event_id = ? AND face = ? AND version = ?`
+
+	avatar, err := scanAvatar(database.DB.QueryRow(query, eventID, face, version))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return avatar, err
+}
+
+// GetAvatarVersions returns every version of the avatar of a face, newest first
+func GetAvatarVersions(eventID int, face string) ([]model.Avatar, error) {
+	return queryAvatars(`SELECT `+avatarColumns+` FROM avatar WHERE event_id = ? AND face = ? ORDER BY version DESC`, eventID, face)
+}
+
+// GetAllAvatarVersions returns every version of every avatar of an event
+func GetAllAvatarVersions(eventID int) ([]model.Avatar, error) {
+	return queryAvatars(`SELECT `+avatarColumns+` FROM avatar WHERE event_id = ? ORDER BY face, version`, eventID)
+}
+
+// NextAvatarVersion returns the number the next avatar version of a face gets
+func NextAvatarVersion(eventID int, face string) (int, error) {
+	var version int
+	err := database.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM avatar WHERE event_id = ? AND face = ?`,
+		eventID, face).Scan(&version)
+	return version, err
+}
+
+// SetAvatar records avatar as a new version of the avatar of its face and
+// makes it the current one; previous versions are kept
+func SetAvatar(avatar *model.Avatar) error {
+	avatar.Current = true
+	return AddAvatarVersion(avatar)
+}
+
+// AddAvatarVersion records avatar as a version of the avatar of its face. A
+// zero Version is numbered after the existing ones. If avatar is Current, the
+// previously current version is no longer; an empty CreatedAt means now.
+func AddAvatarVersion(avatar *model.Avatar) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if avatar.Version == 0 {
+		err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM avatar WHERE event_id = ? AND face = ?`,
+			avatar.EventID, avatar.Face).Scan(&avatar.Version)
+		if err != nil {
+			return err
+		}
+	}
+	if avatar.Current {
+		if _, err := tx.Exec(`UPDATE avatar SET is_current = 0 WHERE event_id = ? AND face = ?`, avatar.EventID, avatar.Face); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(`
+    INSERT INTO avatar (event_id, face, filename, source, qq_number, created_at, version, is_current, uploaded_by, uploader_ip)
+    VALUES (?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), ?, ?, ?, ?)
+    `, avatar.EventID, avatar.Face, avatar.Filename, avatar.Source, nullString(avatar.QQNumber), nullString(avatar.CreatedAt),
+		avatar.Version, avatar.Current, nullString(avatar.UploadedBy), nullString(avatar.UploaderIP))
+	if err != nil {
+		return err
+	}
+	if avatar.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetCurrentAvatar makes version the current avatar of a face. It returns
+// false if the face has no such version.
+func SetCurrentAvatar(eventID int, face string, version int) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM avatar WHERE event_id = ? AND face = ? AND version = ?)`,
+		eventID, face, version).Scan(&exists)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`UPDATE avatar SET is_current = 0 WHERE event_id = ? AND face = ?`, eventID, face); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE avatar SET is_current = 1 WHERE event_id = ? AND face = ? AND version = ?`, eventID, face, version); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// DeleteAvatar deletes every version of the avatar of a face
+func DeleteAvatar(eventID int, face string) error {
+	_, err := database.DB.Exec(`DELETE FROM avatar WHERE event_id = ? AND face = ?`, eventID, face)
+	return err
+}
+
+// AvatarMove re-points the avatar version with the given ID to face To, now
+// stored as Filename. An empty To drops the record.
+type AvatarMove struct {
+	ID       int64
+	To       string
+	Filename string
+}
+
+// MoveAvatars applies all moves at once, so faces may swap avatars
+func MoveAvatars(eventID int, moves []AvatarMove) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Park the records under a name of their own first: (face, version) is
+	// unique, so moving straight onto a face that is itself about to move
+	// would collide
+	for _, m := range moves {
+		if _, err := tx.Exec(`UPDATE avatar SET face = '.moving-' || id WHERE id = ? AND event_id = ?`, m.ID, eventID); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range moves {
+		if m.To == "" {
+			_, err = tx.Exec(`DELETE FROM avatar WHERE id = ? AND event_id = ?`, m.ID, eventID)
+		} else {
+			_, err = tx.Exec(`UPDATE avatar SET face = ?, filename = ? WHERE id = ? AND event_id = ?`, m.To, m.Filename, m.ID, eventID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// nullString returns NULL for an empty string
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
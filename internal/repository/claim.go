@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"database/sql"
+
+	"avatar-face-swap-go/internal/database"
+	"avatar-face-swap-go/internal/model"
+)
+
+const claimColumns = `event_id, face, session_id, claimed_at`
+
+func scanClaim(row interface{ Scan(...any) error }) (*model.FaceClaim, error) {
+	var claim model.FaceClaim
+	err := row.Scan(&claim.EventID, &claim.Face, &claim.SessionID, &claim.ClaimedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// GetFaceClaim returns the claim on a face, or nil if it is unclaimed
+func GetFaceClaim(eventID int, face string) (*model.FaceClaim, error) {
+	query := `SELECT ` + claimColumns + ` FROM face_claim WHERE event_id = ? AND face = ?`
+
+	claim, err := scanClaim(database.DB.QueryRow(query, eventID, face))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return claim, err
+}
+
+// GetSessionClaim returns the face a session holds in an event, or nil
+func GetSessionClaim(eventID int, sessionID string) (*model.FaceClaim, error) {
+	query := `SELECT ` + claimColumns + ` FROM face_claim WHERE event_id = ? AND session_id = ?`
+
+	claim, err := scanClaim(database.DB.QueryRow(query, eventID, sessionID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return claim, err
+}
+
+func GetFaceClaims(eventID int) ([]model.FaceClaim, error) {
+	rows, err := database.DB.Query(`SELECT `+claimColumns+` FROM face_claim WHERE event_id = ? ORDER BY face`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claims := []model.FaceClaim{}
+	for rows.Next() {
+		claim, err := scanClaim(rows)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, *claim)
+	}
+
+	return claims, rows.Err()
+}
+
+// CreateFaceClaim claims an unclaimed face for a session. It returns false,
+// leaving everything as it was, if the face or the session already has a claim.
+func CreateFaceClaim(eventID int, face, sessionID string) (bool, error) {
+	result, err := database.DB.Exec(`INSERT OR IGNORE INTO face_claim (event_id, face, session_id) VALUES (?, ?, ?)`,
+		eventID, face, sessionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetFaceClaim gives a face to a session, replacing the current claimant and
+// releasing any other face the session held in the event
+func SetFaceClaim(eventID int, face, sessionID string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM face_claim WHERE event_id = ? AND (face = ? OR session_id = ?)`, eventID, face, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO face_claim (event_id, face, session_id) VALUES (?, ?, ?)`, eventID, face, sessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteFaceClaim releases a face; it reports whether it was claimed
+func DeleteFaceClaim(eventID int, face string) (bool, error) {
+	result, err := database.DB.Exec(`DELETE FROM face_claim WHERE event_id = ? AND face = ?`, eventID, face)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteFaceClaims releases every face of an event
+func DeleteFaceClaims(eventID int) error {
+	_, err := database.DB.Exec(`DELETE FROM face_claim WHERE event_id = ?`, eventID)
+	return err
+}
+
+// MoveFaceClaims re-points the claims on the faces in moves (previous face ->
+// new face) all at once, so faces may swap claims. An empty new face drops
+// the claim.
+func MoveFaceClaims(eventID int, moves map[string]string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Park the claims first, the face is the primary key
+	for from := range moves {
+		if _, err := tx.Exec(`UPDATE face_claim SET face = '.moving-' || face WHERE event_id = ? AND face = ?`, eventID, from); err != nil {
+			return err
+		}
+	}
+
+	for from, to := range moves {
+		if to == "" {
+			_, err = tx.Exec(`DELETE FROM face_claim WHERE event_id = ? AND face = ?`, eventID, ".moving-"+from)
+		} else {
+			_, err = tx.Exec(`UPDATE face_claim SET face = ? WHERE event_id = ? AND face = ?`, to, eventID, ".moving-"+from)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
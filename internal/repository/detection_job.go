@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"avatar-face-swap-go/internal/database"
+	"avatar-face-swap-go/internal/model"
+)
+
+const detectionJobColumns = `id, event_id, status, mode, attempts, error, retry_at, faces_count, report, created_at, started_at, finished_at`
+
+func scanDetectionJob(row interface{ Scan(...any) error }) (*model.DetectionJob, error) {
+	var job model.DetectionJob
+	var errText, retryAt, report, startedAt, finishedAt sql.NullString
+	var facesCount sql.NullInt64
+
+	err := row.Scan(
+		&job.ID,
+		&job.EventID,
+		&job.Status,
+		&job.Mode,
+		&job.Attempts,
+		&errText,
+		&retryAt,
+		&facesCount,
+		&report,
+		&job.CreatedAt,
+		&startedAt,
+		&finishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Error = errText.String
+	job.RetryAt = retryAt.String
+	job.StartedAt = startedAt.String
+	job.FinishedAt = finishedAt.String
+	if report.Valid {
+		job.Report = json.RawMessage(report.String)
+	}
+	if facesCount.Valid {
+		n := int(facesCount.Int64)
+		job.FacesCount = &n
+	}
+	return &job, nil
+}
+
+// CreateDetectionJob queues a new job for the event. Jobs still waiting for the
+// same event are marked failed, since they would process a replaced picture.
+// A merge never supersedes a pending replace: the new picture has not been
+// detected yet, so there is nothing to merge with.
+func CreateDetectionJob(eventID int, mode string) (int64, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if mode == model.JobModeMerge {
+		var pending int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM detection_job WHERE event_id = ? AND status = ? AND mode = ?`,
+			eventID, model.JobQueued, model.JobModeReplace).Scan(&pending)
+		if err != nil {
+			return 0, err
+		}
+		if pending > 0 {
+			mode = model.JobModeReplace
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE detection_job SET status = ?, error = ?, finished_at = CURRENT_TIMESTAMP
+                      WHERE event_id = ? AND status = ?`,
+		model.JobFailed, "superseded by a newer request", eventID, model.JobQueued)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`INSERT INTO detection_job (event_id, status, mode) VALUES (?, ?, ?)`, eventID, model.JobQueued, mode)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+func GetLatestDetectionJob(eventID int) (*model.DetectionJob, error) {
+	query := `SELECT ` + detectionJobColumns + ` FROM detection_job
+              WHERE event_id = ? ORDER BY id DESC LIMIT 1`
+
+	job, err := scanDetectionJob(database.DB.QueryRow(query, eventID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// ClaimDetectionJob marks the oldest queued job as running and returns it, or
+// nil when nothing is queued. Jobs waiting to be retried and events that
+// already have a running job are skipped, so two workers never process the
+// same picture.
+func ClaimDetectionJob() (*model.DetectionJob, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + detectionJobColumns + ` FROM detection_job
+              WHERE status = ? AND (retry_at IS NULL OR retry_at <= CURRENT_TIMESTAMP)
+                AND event_id NOT IN (SELECT event_id FROM detection_job WHERE status = ?)
+              ORDER BY id LIMIT 1`
+	job, err := scanDetectionJob(tx.QueryRow(query, model.JobQueued, model.JobRunning))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`UPDATE detection_job SET status = ?, attempts = attempts + 1, retry_at = NULL, started_at = CURRENT_TIMESTAMP
+                            WHERE id = ? AND status = ?`,
+		model.JobRunning, job.ID, model.JobQueued)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, nil // claimed by another worker
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	job.Status = model.JobRunning
+	job.Attempts++
+	return job, nil
+}
+
+// CompleteDetectionJob marks the job succeeded; report may be nil
+func CompleteDetectionJob(id int64, facesCount int, report []byte) error {
+	var reportText *string
+	if report != nil {
+		s := string(report)
+		reportText = &s
+	}
+	_, err := database.DB.Exec(`UPDATE detection_job SET status = ?, error = NULL, faces_count = ?, report = ?, finished_at = CURRENT_TIMESTAMP
+                                WHERE id = ?`,
+		model.JobSucceeded, facesCount, reportText, id)
+	return err
+}
+
+// RetryDetectionJob records the error and puts the job back in the queue, to
+// be claimed again once delay has passed
+func RetryDetectionJob(id int64, errText string, delay time.Duration) error {
+	_, err := database.DB.Exec(`UPDATE detection_job SET status = ?, error = ?, retry_at = datetime('now', ?) WHERE id = ?`,
+		model.JobQueued, errText, fmt.Sprintf("+%d seconds", int(delay.Seconds())), id)
+	return err
+}
+
+// FailDetectionJob records the error and finishes the job as failed
+func FailDetectionJob(id int64, errText string) error {
+	_, err := database.DB.Exec(`UPDATE detection_job SET status = ?, error = ?, finished_at = CURRENT_TIMESTAMP
+                                WHERE id = ?`,
+		model.JobFailed, errText, id)
+	return err
+}
+
+// RequeueRunningDetectionJobs puts jobs interrupted by a restart back in the queue
+func RequeueRunningDetectionJobs() (int64, error) {
+	result, err := database.DB.Exec(`UPDATE detection_job SET status = ? WHERE status = ?`,
+		model.JobQueued, model.JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -2,17 +2,19 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
 	"strings"
+	"time"
 
 	"avatar-face-swap-go/internal/database"
 	"avatar-face-swap-go/internal/model"
 )
 
 func GetEventByID(id int) (*model.Event, error) {
-	query := `SELECT event_id, description, token, event_date, is_open, creator 
-              FROM event WHERE event_id = ?`
+	query := `SELECT event_id, description, token, event_date, is_open, creator, composite_settings, detection_settings 
+              FROM event WHERE event_id = ? AND deleted_at IS NULL`
 	var event model.Event
-	var creator sql.NullString
+	var creator, composite, detection sql.NullString
 
 	err := database.DB.QueryRow(query, id).Scan(
 		&event.ID,
@@ -21,6 +23,8 @@ func GetEventByID(id int) (*model.Event, error) {
 		&event.EventDate,
 		&event.IsOpen,
 		&creator,
+		&composite,
+		&detection,
 	)
 
 	if err == sql.ErrNoRows {
@@ -33,12 +37,22 @@ func GetEventByID(id int) (*model.Event, error) {
 	if creator.Valid {
 		event.Creator = creator.String
 	}
+	if composite.Valid {
+		if err := json.Unmarshal([]byte(composite.String), &event.Composite); err != nil {
+			return nil, err
+		}
+	}
+	if detection.Valid {
+		if err := json.Unmarshal([]byte(detection.String), &event.Detection); err != nil {
+			return nil, err
+		}
+	}
 
 	return &event, nil
 }
 
 func GetAllEvents() ([]model.Event, error) {
-	query := `SELECT event_id, description, event_date, is_open FROM event`
+	query := `SELECT event_id, description, event_date, is_open FROM event WHERE deleted_at IS NULL`
 
 	rows, err := database.DB.Query(query)
 	if err != nil {
@@ -82,11 +96,11 @@ func CreateEvent(req *model.CreateEventRequest, creator string) (int64, error) {
 }
 
 func GetEventByToken(token string) (*model.Event, error) {
-	query := `SELECT event_id, description, token, event_date, is_open, creator 
-              FROM event WHERE token = ?`
+	query := `SELECT event_id, description, token, event_date, is_open, creator, composite_settings, detection_settings 
+              FROM event WHERE token = ? AND deleted_at IS NULL`
 
 	var event model.Event
-	var creator sql.NullString
+	var creator, composite, detection sql.NullString
 
 	err := database.DB.QueryRow(query, token).Scan(
 		&event.ID,
@@ -95,6 +109,8 @@ func GetEventByToken(token string) (*model.Event, error) {
 		&event.EventDate,
 		&event.IsOpen,
 		&creator,
+		&composite,
+		&detection,
 	)
 
 	if err == sql.ErrNoRows {
@@ -107,6 +123,16 @@ func GetEventByToken(token string) (*model.Event, error) {
 	if creator.Valid {
 		event.Creator = creator.String
 	}
+	if composite.Valid {
+		if err := json.Unmarshal([]byte(composite.String), &event.Composite); err != nil {
+			return nil, err
+		}
+	}
+	if detection.Valid {
+		if err := json.Unmarshal([]byte(detection.String), &event.Detection); err != nil {
+			return nil, err
+		}
+	}
 
 	return &event, nil
 }
@@ -135,6 +161,22 @@ func UpdateEvent(id int, req *model.UpdateEventRequest) error {
 		fields = append(fields, "is_open = ?")
 		args = append(args, isOpen)
 	}
+	if req.Composite != nil {
+		composite, err := json.Marshal(req.Composite)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "composite_settings = ?")
+		args = append(args, string(composite))
+	}
+	if req.Detection != nil {
+		detection, err := json.Marshal(req.Detection)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "detection_settings = ?")
+		args = append(args, string(detection))
+	}
 
 	if len(fields) == 0 {
 		return nil
@@ -147,7 +189,138 @@ func UpdateEvent(id int, req *model.UpdateEventRequest) error {
 	return err
 }
 
+// TrashEvent hides the event until it is restored or purged
+func TrashEvent(id int) error {
+	_, err := database.DB.Exec(`UPDATE event SET deleted_at = CURRENT_TIMESTAMP WHERE event_id = ? AND deleted_at IS NULL`, id)
+	return err
+}
+
+func RestoreEvent(id int) error {
+	_, err := database.DB.Exec(`UPDATE event SET deleted_at = NULL WHERE event_id = ?`, id)
+	return err
+}
+
+// GetTrashedEvents lists trashed events, oldest deletion first
+func GetTrashedEvents() ([]model.Event, error) {
+	query := `SELECT event_id, description, event_date, is_open, deleted_at FROM event
+              WHERE deleted_at IS NOT NULL ORDER BY deleted_at`
+
+	rows, err := database.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []model.Event{}
+	for rows.Next() {
+		var e model.Event
+		if err := rows.Scan(&e.ID, &e.Description, &e.EventDate, &e.IsOpen, &e.DeletedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// GetTrashedEvent returns a trashed event, or nil if the event is not in the trash
+func GetTrashedEvent(id int) (*model.Event, error) {
+	query := `SELECT event_id, description, event_date, is_open, deleted_at FROM event
+              WHERE event_id = ? AND deleted_at IS NOT NULL`
+
+	var e model.Event
+	err := database.DB.QueryRow(query, id).Scan(&e.ID, &e.Description, &e.EventDate, &e.IsOpen, &e.DeletedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// GetExpiredTrashedEventIDs returns the events trashed before the cutoff
+func GetExpiredTrashedEventIDs(before time.Time) ([]int, error) {
+	rows, err := database.DB.Query(`SELECT event_id FROM event WHERE deleted_at IS NOT NULL AND deleted_at < ?`,
+		before.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetEventIDs returns the IDs of all events, including trashed ones
+func GetEventIDs() (map[int]bool, error) {
+	rows, err := database.DB.Query(`SELECT event_id FROM event`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// DeleteEvent removes the event together with its faces, avatars, claims and jobs
 func DeleteEvent(id int) error {
-	_, err := database.DB.Exec("DELETE FROM event WHERE event_id = ?", id)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM avatar WHERE event_id = ?",
+		"DELETE FROM face WHERE event_id = ?",
+		"DELETE FROM face_claim WHERE event_id = ?",
+		"DELETE FROM detection_job WHERE event_id = ?",
+		"DELETE FROM event WHERE event_id = ?",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetEventPicture returns the dimensions of the event picture, or nil if no
+// picture has been processed yet
+func GetEventPicture(id int) (*model.ImageInfo, error) {
+	var width, height sql.NullInt64
+	err := database.DB.QueryRow(`SELECT picture_width, picture_height FROM event WHERE event_id = ?`, id).Scan(&width, &height)
+	if err == sql.ErrNoRows || (err == nil && !width.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.ImageInfo{
+		Width:    int(width.Int64),
+		Height:   int(height.Int64),
+		Filename: "original.jpg",
+	}, nil
+}
+
+func UpdateEventPicture(id, width, height int) error {
+	_, err := database.DB.Exec(`UPDATE event SET picture_width = ?, picture_height = ? WHERE event_id = ?`, width, height, id)
 	return err
 }
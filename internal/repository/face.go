@@ -0,0 +1,190 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"avatar-face-swap-go/internal/database"
+	"avatar-face-swap-go/internal/model"
+)
+
+const faceColumns = `filename, x1, y1, x2, y2, confidence, manual, face_id, landmarks, pose, quality`
+
+func scanFace(row interface{ Scan(...any) error }) (*model.Face, error) {
+	var face model.Face
+	var confidence sql.NullFloat64
+	var faceID, landmarks, pose, quality sql.NullString
+
+	err := row.Scan(
+		&face.Filename,
+		&face.Coordinates.X1,
+		&face.Coordinates.Y1,
+		&face.Coordinates.X2,
+		&face.Coordinates.Y2,
+		&confidence,
+		&face.Manual,
+		&faceID,
+		&landmarks,
+		&pose,
+		&quality,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	face.Confidence = confidence.Float64
+	face.FaceID = faceID.String
+	if landmarks.Valid {
+		if err := json.Unmarshal([]byte(landmarks.String), &face.Landmarks); err != nil {
+			return nil, err
+		}
+	}
+	if pose.Valid {
+		if err := json.Unmarshal([]byte(pose.String), &face.Pose); err != nil {
+			return nil, err
+		}
+	}
+	if quality.Valid {
+		if err := json.Unmarshal([]byte(quality.String), &face.Quality); err != nil {
+			return nil, err
+		}
+	}
+	return &face, nil
+}
+
+// faceArgs returns the column values of faceColumns after filename
+func faceArgs(face *model.Face) ([]any, error) {
+	landmarks, err := nullJSON(face.Landmarks != nil, face.Landmarks)
+	if err != nil {
+		return nil, err
+	}
+	pose, err := nullJSON(face.Pose != nil, face.Pose)
+	if err != nil {
+		return nil, err
+	}
+	quality, err := nullJSON(face.Quality != nil, face.Quality)
+	if err != nil {
+		return nil, err
+	}
+
+	var faceID *string
+	if face.FaceID != "" {
+		faceID = &face.FaceID
+	}
+
+	return []any{
+		face.Coordinates.X1,
+		face.Coordinates.Y1,
+		face.Coordinates.X2,
+		face.Coordinates.Y2,
+		face.Confidence,
+		face.Manual,
+		faceID,
+		landmarks,
+		pose,
+		quality,
+	}, nil
+}
+
+// nullJSON marshals v, or returns NULL when set is false
+func nullJSON(set bool, v any) (*string, error) {
+	if !set {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+// GetFaces returns the faces of an event in detection order
+func GetFaces(eventID int) ([]model.Face, error) {
+	rows, err := database.DB.Query(`SELECT `+faceColumns+` FROM face WHERE event_id = ? ORDER BY id`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	faces := []model.Face{}
+	for rows.Next() {
+		face, err := scanFace(rows)
+		if err != nil {
+			return nil, err
+		}
+		faces = append(faces, *face)
+	}
+
+	return faces, rows.Err()
+}
+
+func GetFace(eventID int, filename string) (*model.Face, error) {
+	query := `SELECT ` + faceColumns + ` FROM face WHERE event_id = ? AND filename = ?`
+
+	face, err := scanFace(database.DB.QueryRow(query, eventID, filename))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return face, err
+}
+
+func CreateFace(eventID int, face *model.Face) error {
+	args, err := faceArgs(face)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO face (event_id, ` + faceColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = database.DB.Exec(query, append([]any{eventID, face.Filename}, args...)...)
+	return err
+}
+
+// UpdateFace overwrites every field of the face with the same filename
+func UpdateFace(eventID int, face *model.Face) error {
+	args, err := faceArgs(face)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE face SET x1 = ?, y1 = ?, x2 = ?, y2 = ?, confidence = ?, manual = ?, face_id = ?,
+              landmarks = ?, pose = ?, quality = ? WHERE event_id = ? AND filename = ?`
+	_, err = database.DB.Exec(query, append(args, eventID, face.Filename)...)
+	return err
+}
+
+// ReplaceFaces swaps the whole face set of an event in one transaction
+func ReplaceFaces(eventID int, faces []model.Face) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM face WHERE event_id = ?`, eventID); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO face (event_id, ` + faceColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := range faces {
+		args, err := faceArgs(&faces[i])
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(append([]any{eventID, faces[i].Filename}, args...)...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func DeleteFace(eventID int, filename string) error {
+	_, err := database.DB.Exec(`DELETE FROM face WHERE event_id = ? AND filename = ?`, eventID, filename)
+	return err
+}
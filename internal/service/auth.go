@@ -15,13 +15,16 @@ var (
 	ErrExpiredToken = errors.New("token expired")
 )
 
-func GenerateJWT(userID, role, email string) (string, error) {
-	cfg := config.Load()
+// GenerateJWT signs a token for a user. sessionID identifies a participant
+// across their requests and is empty for admins.
+func GenerateJWT(userID, role, email, sessionID string) (string, error) {
+	cfg := config.Current()
 
 	claims := model.JWTClaims{
 		UserID:    userID,
 		Role:      role,
 		UserEmail: email,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -33,7 +36,7 @@ func GenerateJWT(userID, role, email string) (string, error) {
 }
 
 func ValidateJWT(tokenString string) (*model.JWTClaims, error) {
-	cfg := config.Load()
+	cfg := config.Current()
 	token, err := jwt.ParseWithClaims(tokenString, &model.JWTClaims{}, func(t *jwt.Token) (any, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, ErrInvalidToken
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// ErrAvatarVersionNotFound is returned when rolling back to a version a face
+// doesn't have, or whose file is gone
+var ErrAvatarVersionNotFound = errors.New("avatar version not found")
+
+// AvatarVersionFilename is the file an avatar version of a face is stored as,
+// e.g. face_1.v3.png. Avatars uploaded before versioning keep their name.
+func AvatarVersionFilename(face string, version int, ext string) string {
+	return fmt.Sprintf("%s.v%d%s", faceBaseName(face), version, ext)
+}
+
+// SaveAvatarVersion stores the image read from r as a new version of the
+// avatar of avatar.Face and makes it current. Earlier versions stay available
+// for rollback. avatar is filled in with the version, filename and ID.
+func SaveAvatarVersion(avatar *model.Avatar, ext string, size int64, r io.Reader) error {
+	unlock := storage.LockEvent(avatar.EventID)
+	defer unlock()
+
+	version, err := repository.NextAvatarVersion(avatar.EventID, avatar.Face)
+	if err != nil {
+		return err
+	}
+	// Every version is kept, so the upload frees no space
+	if err := CheckUploadQuota(avatar.EventID, size); err != nil {
+		return err
+	}
+
+	avatar.Version = version
+	avatar.Filename = AvatarVersionFilename(avatar.Face, version, ext)
+	key := storage.AvatarKey(avatar.EventID, avatar.Filename)
+	if err := storage.Put(key, r); err != nil {
+		return err
+	}
+
+	if err := repository.SetAvatar(avatar); err != nil {
+		if delErr := storage.Delete(key); delErr != nil {
+			log.Printf("[Avatar] Failed to remove %s after failed save: %v", avatar.Filename, delErr)
+		}
+		return err
+	}
+
+	InvalidateComposite(avatar.EventID)
+	return nil
+}
+
+// RollbackAvatar makes an earlier version the current avatar of a face
+func RollbackAvatar(eventID int, face string, version int) (*model.Avatar, error) {
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	avatar, err := repository.GetAvatarVersion(eventID, face, version)
+	if err != nil {
+		return nil, err
+	}
+	if avatar == nil {
+		return nil, ErrAvatarVersionNotFound
+	}
+	if !storage.Exists(storage.AvatarKey(eventID, avatar.Filename)) {
+		return nil, fmt.Errorf("%w: file %s is gone", ErrAvatarVersionNotFound, avatar.Filename)
+	}
+
+	ok, err := repository.SetCurrentAvatar(eventID, face, version)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAvatarVersionNotFound
+	}
+	avatar.Current = true
+
+	InvalidateComposite(eventID)
+	log.Printf("[Avatar] Event %d: %s rolled back to version %d", eventID, face, version)
+	return avatar, nil
+}
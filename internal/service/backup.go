@@ -0,0 +1,471 @@
+package service
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/database"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// BackupVersion is the manifest format written by CreateBackup
+const BackupVersion = 1
+
+const (
+	backupManifestName = "manifest.json"
+	backupDatabaseName = "app.db"
+	backupStoragePath  = "storage/"
+	backupTimeFormat   = "20060102-150405"
+)
+
+// ErrInvalidBackup wraps every reason a backup fails verification
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// BackupManifest lists every file of a backup with its checksum
+type BackupManifest struct {
+	Version   int          `json:"version"`
+	CreatedAt string       `json:"created_at"`
+	Files     []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"` // app.db, or storage/<key>
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupInfo describes a backup archive in the backup directory
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// backupMu keeps scheduled and requested backups from running at once
+var backupMu sync.Mutex
+
+// CreateBackup writes a timestamped zip with a snapshot of the database and
+// every storage object to dir. The database snapshot is consistent; storage
+// objects are copied afterwards, so files changed during the backup may be
+// newer than the database.
+func CreateBackup(dir string) (*BackupInfo, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	name := "backup-" + now.Format(backupTimeFormat) + ".zip"
+	target := filepath.Join(dir, name)
+	if _, err := os.Stat(target); err == nil {
+		return nil, fmt.Errorf("backup %s already exists", name)
+	}
+
+	log.Printf("[Backup] Creating %s", name)
+
+	tmp, err := os.CreateTemp(dir, ".backup-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	manifest, err := writeBackup(tmp, dir, now)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Backup] Created %s: %d files, %d bytes", name, len(manifest.Files), info.Size())
+	return &BackupInfo{Name: name, Size: info.Size(), CreatedAt: now}, nil
+}
+
+func writeBackup(w io.Writer, dir string, now time.Time) (*BackupManifest, error) {
+	manifest := &BackupManifest{
+		Version:   BackupVersion,
+		CreatedAt: now.Format(time.RFC3339),
+		Files:     []BackupFile{},
+	}
+	zw := zip.NewWriter(w)
+
+	// VACUUM INTO refuses to overwrite, so the snapshot goes to a fresh name
+	snapshot := filepath.Join(dir, fmt.Sprintf(".snapshot-%d.db", now.UnixNano()))
+	if err := database.Snapshot(snapshot); err != nil {
+		return nil, fmt.Errorf("database snapshot: %w", err)
+	}
+	defer os.Remove(snapshot)
+
+	db, err := os.Open(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	file, err := addToBackup(zw, backupDatabaseName, now, db)
+	db.Close()
+	if err != nil {
+		return nil, err
+	}
+	manifest.Files = append(manifest.Files, *file)
+
+	objects, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		r, err := storage.Get(obj.Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue // deleted since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		file, err := addToBackup(zw, backupStoragePath+obj.Key, obj.ModTime, r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", obj.Key, err)
+		}
+		manifest.Files = append(manifest.Files, *file)
+	}
+
+	mw, err := zw.CreateHeader(backupHeader(backupManifestName, now))
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, zw.Close()
+}
+
+func backupHeader(name string, modified time.Time) *zip.FileHeader {
+	return &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified}
+}
+
+func addToBackup(zw *zip.Writer, name string, modified time.Time, r io.Reader) (*BackupFile, error) {
+	w, err := zw.CreateHeader(backupHeader(name, modified))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, sum), r)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupFile{Name: name, Size: n, SHA256: hex.EncodeToString(sum.Sum(nil))}, nil
+}
+
+// ListBackups returns the backups in dir, newest first
+func ListBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []BackupInfo{}
+	for _, e := range entries {
+		created, ok := parseBackupName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, BackupInfo{Name: e.Name(), Size: info.Size(), CreatedAt: created})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// BackupPath returns the path of a backup in dir, rejecting names that are
+// not backups written by CreateBackup
+func BackupPath(dir, name string) (string, bool) {
+	if _, ok := parseBackupName(name); !ok {
+		return "", false
+	}
+	return filepath.Join(dir, name), true
+}
+
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, "backup-") || !strings.HasSuffix(name, ".zip") {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, "backup-"), ".zip"))
+	return t, err == nil
+}
+
+// PruneBackups deletes all but the newest keep backups in dir and returns how
+// many were deleted. keep <= 0 keeps everything.
+func PruneBackups(dir string, keep int) (int, error) {
+	if keep <= 0 {
+		return 0, nil
+	}
+
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, b := range backups[min(keep, len(backups)):] {
+		if err := os.Remove(filepath.Join(dir, b.Name)); err != nil {
+			return deleted, err
+		}
+		log.Printf("[Backup] Deleted old backup %s", b.Name)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// VerifyBackup checks that the archive holds exactly the files its manifest
+// lists, with matching sizes and checksums, and that every name is safe to
+// restore. It reads the whole archive.
+func VerifyBackup(zr *zip.Reader) (*BackupManifest, error) {
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		if !validBackupEntry(f.Name) {
+			return nil, fmt.Errorf("%w: unexpected entry %q", ErrInvalidBackup, f.Name)
+		}
+		if entries[f.Name] != nil {
+			return nil, fmt.Errorf("%w: duplicate entry %q", ErrInvalidBackup, f.Name)
+		}
+		entries[f.Name] = f
+	}
+
+	mf := entries[backupManifestName]
+	if mf == nil {
+		return nil, fmt.Errorf("%w: %s missing", ErrInvalidBackup, backupManifestName)
+	}
+	r, err := mf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	var manifest BackupManifest
+	err = json.NewDecoder(r).Decode(&manifest)
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad manifest: %v", ErrInvalidBackup, err)
+	}
+	if manifest.Version < 1 || manifest.Version > BackupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, manifest.Version)
+	}
+
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		f := entries[file.Name]
+		if f == nil || file.Name == backupManifestName || listed[file.Name] {
+			return nil, fmt.Errorf("%w: %s not in archive", ErrInvalidBackup, file.Name)
+		}
+		listed[file.Name] = true
+
+		size, sum, err := hashZipFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidBackup, file.Name, err)
+		}
+		if size != file.Size || sum != file.SHA256 {
+			return nil, fmt.Errorf("%w: %s: checksum mismatch", ErrInvalidBackup, file.Name)
+		}
+	}
+	if !listed[backupDatabaseName] {
+		return nil, fmt.Errorf("%w: %s missing", ErrInvalidBackup, backupDatabaseName)
+	}
+	for name := range entries {
+		if name != backupManifestName && !listed[name] {
+			return nil, fmt.Errorf("%w: entry %q not listed in manifest", ErrInvalidBackup, name)
+		}
+	}
+	return &manifest, nil
+}
+
+func validBackupEntry(name string) bool {
+	if name == backupManifestName || name == backupDatabaseName {
+		return true
+	}
+	key, ok := strings.CutPrefix(name, backupStoragePath)
+	if !ok || key == "" || strings.Contains(key, "\\") {
+		return false
+	}
+	return path.Clean("/"+key) == "/"+key
+}
+
+func hashZipFile(f *zip.File) (int64, string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+
+	sum := sha256.New()
+	n, err := io.Copy(sum, r)
+	return n, hex.EncodeToString(sum.Sum(nil)), err
+}
+
+// RestoreBackup replaces the database at dbPath and every storage object with
+// the contents of a backup. The archive is verified first, so a damaged backup
+// changes nothing. The server must be stopped: the database file is swapped
+// underneath any open connection. The replaced database is kept next to the
+// new one as <db>.before-restore-<time>.
+func RestoreBackup(file, dbPath string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	manifest, err := VerifyBackup(&zr.Reader)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Backup] Verified %s: %d files from %s", filepath.Base(file), len(manifest.Files), manifest.CreatedAt)
+
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	// Storage first: if it fails halfway the old database is still in place
+	restored := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		key, ok := strings.CutPrefix(file.Name, backupStoragePath)
+		if !ok {
+			continue
+		}
+		if err := copyFromArchive(entries[file.Name], key); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		restored[key] = true
+	}
+
+	objects, err := storage.List("")
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, obj := range objects {
+		if restored[obj.Key] {
+			continue
+		}
+		if err := storage.Delete(obj.Key); err != nil {
+			return err
+		}
+		removed++
+	}
+	log.Printf("[Backup] Restored %d storage objects, removed %d not in the backup", len(restored), removed)
+
+	return restoreDatabase(entries[backupDatabaseName], dbPath)
+}
+
+func restoreDatabase(f *zip.File, dbPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return err
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dbPath), "."+filepath.Base(dbPath)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		previous := dbPath + ".before-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		if err := os.Rename(dbPath, previous); err != nil {
+			return err
+		}
+		log.Printf("[Backup] Previous database kept as %s", previous)
+	}
+	// Journals of the replaced database must not be applied to the restored one
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), dbPath); err != nil {
+		return err
+	}
+	log.Printf("[Backup] Restored database to %s", dbPath)
+	return nil
+}
+
+// StartBackupScheduler creates a backup every cfg.BackupIntervalHours and
+// keeps the newest cfg.BackupKeep
+func StartBackupScheduler(cfg *config.Config) {
+	if cfg.BackupIntervalHours <= 0 {
+		return
+	}
+
+	interval := time.Duration(cfg.BackupIntervalHours) * time.Hour
+	log.Printf("[Backup] Scheduled every %s, keeping %d", interval, cfg.BackupKeep)
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			info, err := CreateBackup(cfg.BackupDir)
+			if err != nil {
+				log.Printf("[Backup] Scheduled backup failed: %v", err)
+				LogActivity("ERROR", "系统维护", "定时备份失败", "", "", "", map[string]any{
+					"error": err.Error(),
+				})
+				continue
+			}
+			LogActivity("INFO", "系统维护", "定时备份", "", "", "", map[string]any{
+				"name": info.Name,
+				"size": info.Size,
+			})
+
+			if _, err := PruneBackups(cfg.BackupDir, cfg.BackupKeep); err != nil {
+				log.Printf("[Backup] Failed to delete old backups: %v", err)
+			}
+		}
+	}()
+}
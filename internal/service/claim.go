@@ -0,0 +1,101 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+)
+
+var (
+	// ErrFaceNotFound is returned when claiming a face the event doesn't have
+	ErrFaceNotFound = errors.New("face not found")
+	// ErrFaceClaimed is returned when the face belongs to another session
+	ErrFaceClaimed = errors.New("face claimed by another participant")
+	// ErrSessionHasClaim is returned when the session already holds another
+	// face of the event
+	ErrSessionHasClaim = errors.New("already claimed another face")
+)
+
+// NewSessionID returns a random participant session identity
+func NewSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidSessionID reports whether id looks like one made by NewSessionID
+func ValidSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// ClaimFace claims a face for a participant session. Claiming a face the
+// session already holds succeeds again; a session holds one face per event.
+func ClaimFace(eventID int, face, sessionID string) (*model.FaceClaim, error) {
+	f, err := repository.GetFace(eventID, face)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, ErrFaceNotFound
+	}
+
+	if _, err := repository.CreateFaceClaim(eventID, face, sessionID); err != nil {
+		return nil, err
+	}
+
+	claim, err := repository.GetFaceClaim(eventID, face)
+	if err != nil {
+		return nil, err
+	}
+	if claim != nil && claim.SessionID == sessionID {
+		return claim, nil
+	}
+	if claim == nil {
+		// Not inserted but not claimed either: the session holds another face
+		return nil, ErrSessionHasClaim
+	}
+	return nil, ErrFaceClaimed
+}
+
+// CheckFaceOwner fails unless the session may change the avatar of the face.
+// An unclaimed face is claimed for the session on the way.
+func CheckFaceOwner(eventID int, face, sessionID string) error {
+	claim, err := repository.GetFaceClaim(eventID, face)
+	if err != nil {
+		return err
+	}
+	if claim == nil {
+		_, err = ClaimFace(eventID, face, sessionID)
+		return err
+	}
+	if claim.SessionID != sessionID {
+		return ErrFaceClaimed
+	}
+	return nil
+}
+
+// ReassignFaceClaim gives a face to another session, which loses any other
+// face it held in the event
+func ReassignFaceClaim(eventID int, face, sessionID string) (*model.FaceClaim, error) {
+	f, err := repository.GetFace(eventID, face)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, ErrFaceNotFound
+	}
+
+	if err := repository.SetFaceClaim(eventID, face, sessionID); err != nil {
+		return nil, err
+	}
+	return repository.GetFaceClaim(eventID, face)
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"image"
+	"math"
+)
+
+// Colour matching modes for CompositeSettings.ColorMatch
+const (
+	ColorMatchNone      = "none"
+	ColorMatchMeanStd   = "mean_std"
+	ColorMatchHistogram = "histogram"
+)
+
+const (
+	colorSampleMargin = 0.25 // ring width around the face box, relative to box size
+	maxColorGain      = 2.0  // limit on std-dev scaling so flat avatars don't blow up
+)
+
+// matchColors adjusts the avatar in place so its per-channel statistics match
+// the photo pixels in a ring around the face box.
+func matchColors(avatar *image.RGBA, photo image.Image, box image.Rectangle, mode string) {
+	if mode != ColorMatchMeanStd && mode != ColorMatchHistogram {
+		return
+	}
+
+	target := sampleRing(photo, box)
+	source := sampleOpaque(avatar)
+	if len(target[0]) == 0 || len(source[0]) == 0 {
+		return
+	}
+
+	var luts [3][256]uint8
+	for c := 0; c < 3; c++ {
+		if mode == ColorMatchHistogram {
+			luts[c] = histogramLUT(source[c], target[c])
+		} else {
+			luts[c] = meanStdLUT(source[c], target[c])
+		}
+	}
+
+	// Pixels are premultiplied, so un-premultiply before the lookup
+	for i := 0; i < len(avatar.Pix); i += 4 {
+		a := avatar.Pix[i+3]
+		if a == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			v := int(avatar.Pix[i+c]) * 255 / int(a)
+			avatar.Pix[i+c] = uint8(int(luts[c][min(v, 255)]) * int(a) / 255)
+		}
+	}
+}
+
+// sampleRing collects the photo's pixels in a margin around box, excluding the box itself
+func sampleRing(photo image.Image, box image.Rectangle) [3][]uint8 {
+	marginX := int(float64(box.Dx())*colorSampleMargin + 0.5)
+	marginY := int(float64(box.Dy())*colorSampleMargin + 0.5)
+	outer := image.Rect(box.Min.X-marginX, box.Min.Y-marginY, box.Max.X+marginX, box.Max.Y+marginY).Intersect(photo.Bounds())
+
+	var samples [3][]uint8
+	for y := outer.Min.Y; y < outer.Max.Y; y++ {
+		for x := outer.Min.X; x < outer.Max.X; x++ {
+			if (image.Point{X: x, Y: y}).In(box) {
+				continue
+			}
+			r, g, b, _ := photo.At(x, y).RGBA()
+			samples[0] = append(samples[0], uint8(r>>8))
+			samples[1] = append(samples[1], uint8(g>>8))
+			samples[2] = append(samples[2], uint8(b>>8))
+		}
+	}
+	return samples
+}
+
+// sampleOpaque collects the un-premultiplied colours of the avatar's mostly opaque pixels
+func sampleOpaque(img *image.RGBA) [3][]uint8 {
+	var samples [3][]uint8
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := int(img.Pix[i+3])
+		if a < 128 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			samples[c] = append(samples[c], uint8(min(int(img.Pix[i+c])*255/a, 255)))
+		}
+	}
+	return samples
+}
+
+// meanStdLUT shifts and scales values so the source mean/std-dev match the target's
+func meanStdLUT(source, target []uint8) [256]uint8 {
+	srcMean, srcStd := meanStd(source)
+	dstMean, dstStd := meanStd(target)
+
+	gain := 1.0
+	if srcStd > 1e-6 {
+		gain = math.Max(1/maxColorGain, math.Min(maxColorGain, dstStd/srcStd))
+	}
+
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = clampUint8((float64(v)-srcMean)*gain + dstMean)
+	}
+	return lut
+}
+
+// histogramLUT maps each source level to the target level with the same cumulative frequency
+func histogramLUT(source, target []uint8) [256]uint8 {
+	srcCDF := cdf(source)
+	dstCDF := cdf(target)
+
+	var lut [256]uint8
+	j := 0
+	for v := range lut {
+		for j < 255 && dstCDF[j] < srcCDF[v] {
+			j++
+		}
+		lut[v] = uint8(j)
+	}
+	return lut
+}
+
+func cdf(values []uint8) [256]float64 {
+	var hist [256]float64
+	for _, v := range values {
+		hist[v]++
+	}
+
+	var out [256]float64
+	total := 0.0
+	for v := range hist {
+		total += hist[v]
+		out[v] = total / float64(len(values))
+	}
+	return out
+}
+
+func meanStd(values []uint8) (mean, std float64) {
+	for _, v := range values {
+		mean += float64(v)
+	}
+	mean /= float64(len(values))
+
+	for _, v := range values {
+		d := float64(v) - mean
+		std += d * d
+	}
+	return mean, math.Sqrt(std / float64(len(values)))
+}
+
+func clampUint8(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
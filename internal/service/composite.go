@@ -0,0 +1,245 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"sync"
+
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+
+	"golang.org/x/image/draw"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported composite format")
+
+// Mask shapes for CompositeSettings.MaskShape
+const (
+	MaskRectangle = "rectangle"
+	MaskRounded   = "rounded"
+	MaskCircle    = "circle"
+	MaskEllipse   = "ellipse"
+)
+
+// Blend modes for CompositeSettings.Blend
+const (
+	BlendAlpha    = "alpha"
+	BlendSeamless = "seamless"
+)
+
+// Alignment modes for CompositeSettings.Align
+const (
+	AlignBox       = "box"
+	AlignLandmarks = "landmarks"
+)
+
+const maxFeather = 200
+
+// ValidateCompositeSettings checks user-supplied settings and fills in defaults
+func ValidateCompositeSettings(s *model.CompositeSettings) error {
+	switch s.MaskShape {
+	case "":
+		s.MaskShape = MaskRectangle
+	case MaskRectangle, MaskRounded, MaskCircle, MaskEllipse:
+	default:
+		return fmt.Errorf("invalid mask_shape %q", s.MaskShape)
+	}
+
+	if s.Feather < 0 || s.Feather > maxFeather {
+		return fmt.Errorf("feather must be between 0 and %d", maxFeather)
+	}
+
+	switch s.Align {
+	case "":
+		s.Align = AlignBox
+	case AlignBox, AlignLandmarks:
+	default:
+		return fmt.Errorf("invalid align %q", s.Align)
+	}
+
+	switch s.ColorMatch {
+	case "":
+		s.ColorMatch = ColorMatchNone
+	case ColorMatchNone, ColorMatchMeanStd, ColorMatchHistogram:
+	default:
+		return fmt.Errorf("invalid color_match %q", s.ColorMatch)
+	}
+
+	switch s.Blend {
+	case "":
+		s.Blend = BlendAlpha
+	case BlendAlpha, BlendSeamless:
+	default:
+		return fmt.Errorf("invalid blend %q", s.Blend)
+	}
+	return nil
+}
+
+// compositeMu serializes rendering and invalidation so a stale render can't outlive an avatar change
+var compositeMu sync.Mutex
+
+// avatarExts lists the extensions an uploaded avatar may have
+var avatarExts = []string{".jpg", ".jpeg", ".png"}
+
+// RenderComposite returns the storage key of the finished group photo with every
+// face replaced by its avatar. The result is cached per format until
+// InvalidateComposite is called, so callers must invalidate when settings change.
+func RenderComposite(eventID int, settings model.CompositeSettings, format string) (string, error) {
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	if format != "jpg" && format != "png" {
+		return "", ErrUnsupportedFormat
+	}
+
+	compositeMu.Lock()
+	defer compositeMu.Unlock()
+
+	cacheKey := storage.CompositeKey(eventID, format)
+	if storage.Exists(cacheKey) {
+		return cacheKey, nil
+	}
+
+	log.Printf("[Composite] Rendering %s for event %d", format, eventID)
+
+	canvas, err := renderComposite(eventID, settings)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeImage(cacheKey, canvas, format); err != nil {
+		return "", err
+	}
+	return cacheKey, nil
+}
+
+// RenderColorMatchDebug renders the composite twice, without and with colour
+// matching, and returns both side by side for tuning. The result is not cached.
+func RenderColorMatchDebug(eventID int, settings model.CompositeSettings) (image.Image, error) {
+	plain := settings
+	plain.ColorMatch = ColorMatchNone
+	before, err := renderComposite(eventID, plain)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.ColorMatch == "" || settings.ColorMatch == ColorMatchNone {
+		settings.ColorMatch = ColorMatchMeanStd
+	}
+	after, err := renderComposite(eventID, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := before.Bounds().Dx(), before.Bounds().Dy()
+	sideBySide := image.NewRGBA(image.Rect(0, 0, 2*w, h))
+	draw.Draw(sideBySide, image.Rect(0, 0, w, h), before, before.Bounds().Min, draw.Src)
+	draw.Draw(sideBySide, image.Rect(w, 0, 2*w, h), after, after.Bounds().Min, draw.Src)
+	return sideBySide, nil
+}
+
+func renderComposite(eventID int, settings model.CompositeSettings) (*image.RGBA, error) {
+	metadata, err := LoadMetadata(eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	original, err := decodeImage(storage.OriginalKey(eventID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read original image: %w", err)
+	}
+
+	bounds := original.Bounds()
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, original, bounds.Min, draw.Src)
+
+	pasted := 0
+	for _, face := range metadata.Faces {
+		avatarKey := findAvatarKey(eventID, face.Filename)
+		if avatarKey == "" {
+			continue // no avatar, keep the original pixels
+		}
+
+		avatar, err := decodeImage(avatarKey)
+		if err != nil {
+			log.Printf("[Composite] Skipping %s: %v", face.Filename, err)
+			continue
+		}
+
+		p := facePlacement(face, avatar.Bounds(), settings.Align)
+		if p.w <= 0 || p.h <= 0 {
+			continue
+		}
+
+		scaled := resizeImage(avatar, p.w, p.h)
+		box := image.Rect(face.Coordinates.X1, face.Coordinates.Y1, face.Coordinates.X2, face.Coordinates.Y2)
+		matchColors(scaled, original, box, settings.ColorMatch)
+
+		mask := buildMask(settings.MaskShape, settings.Feather, p.w, p.h)
+		if settings.Blend == BlendSeamless {
+			seamlessPaste(canvas, scaled, mask, p)
+		} else {
+			pasteAvatar(canvas, scaled, mask, p)
+		}
+		pasted++
+	}
+
+	log.Printf("[Composite] Pasted %d/%d avatars for event %d", pasted, len(metadata.Faces), eventID)
+	return canvas, nil
+}
+
+// InvalidateComposite drops the cached composites so the next request re-renders them
+func InvalidateComposite(eventID int) {
+	compositeMu.Lock()
+	defer compositeMu.Unlock()
+
+	for _, format := range []string{"jpg", "png"} {
+		if err := storage.Delete(storage.CompositeKey(eventID, format)); err != nil {
+			log.Printf("[Composite] Failed to drop cached %s for event %d: %v", format, eventID, err)
+		}
+	}
+}
+
+// findAvatarKey returns the avatar uploaded for a face, or "" if there is none.
+func findAvatarKey(eventID int, faceFilename string) string {
+	avatar, err := repository.GetAvatar(eventID, faceFilename)
+	if err != nil {
+		log.Printf("[Composite] Failed to look up avatar of %s: %v", faceFilename, err)
+		return ""
+	}
+	if avatar == nil {
+		return ""
+	}
+
+	key := storage.AvatarKey(eventID, avatar.Filename)
+	if !storage.Exists(key) {
+		return ""
+	}
+	return key
+}
+
+func decodeImage(key string) (image.Image, error) {
+	r, err := storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+func writeImage(key string, img image.Image, format string) error {
+	return storage.Write(key, func(w io.Writer) error {
+		if format == "png" {
+			return png.Encode(w, img)
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	})
+}
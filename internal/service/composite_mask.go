@@ -0,0 +1,62 @@
+package service
+
+import (
+	"image"
+	"math"
+)
+
+const roundedCornerRatio = 0.2 // corner radius relative to the shorter box side
+
+// buildMask returns a w x h alpha mask for the given shape. Pixels fade from
+// opaque to transparent over the last `feather` pixels inside the shape edge,
+// so the avatar never spills outside the face box.
+func buildMask(shape string, feather, w, h int) *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			d := shapeDistance(shape, float64(x)+0.5, float64(y)+0.5, float64(w), float64(h))
+			mask.Pix[y*mask.Stride+x] = uint8(255*featherAlpha(d, feather) + 0.5)
+		}
+	}
+	return mask
+}
+
+// featherAlpha maps a distance inside the shape edge to an opacity in [0,1]
+func featherAlpha(d float64, feather int) float64 {
+	if d <= 0 {
+		return 0
+	}
+	if feather <= 0 || d >= float64(feather) {
+		return 1
+	}
+	// smoothstep gives a softer falloff than a linear ramp
+	t := d / float64(feather)
+	return t * t * (3 - 2*t)
+}
+
+// shapeDistance returns how far (x, y) lies inside the shape fitted to a w x h
+// box; negative values are outside.
+func shapeDistance(shape string, x, y, w, h float64) float64 {
+	switch shape {
+	case MaskCircle:
+		r := math.Min(w, h) / 2
+		return r - math.Hypot(x-w/2, y-h/2)
+
+	case MaskEllipse:
+		a, b := w/2, h/2
+		dx, dy := (x-a)/a, (y-b)/b
+		return (1 - math.Sqrt(dx*dx+dy*dy)) * math.Min(a, b)
+
+	case MaskRounded:
+		r := math.Min(w, h) * roundedCornerRatio
+		// signed distance to a rounded box centred on the origin
+		qx := math.Abs(x-w/2) - (w/2 - r)
+		qy := math.Abs(y-h/2) - (h/2 - r)
+		outside := math.Hypot(math.Max(qx, 0), math.Max(qy, 0))
+		inside := math.Min(math.Max(qx, qy), 0)
+		return r - (outside + inside)
+
+	default:
+		return math.Min(math.Min(x, w-x), math.Min(y, h-y))
+	}
+}
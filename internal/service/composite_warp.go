@@ -0,0 +1,160 @@
+package service
+
+import (
+	"image"
+	"math"
+
+	"avatar-face-swap-go/internal/model"
+)
+
+// Where the eyes sit in a typical head-and-shoulders avatar, relative to its size
+const (
+	templateEyeY       = 0.40
+	templateEyeSpacing = 0.36
+)
+
+// placement describes where an avatar lands in the photo: it is scaled to
+// w x h, rotated by angle (radians, clockwise in image coordinates) and
+// centred on (cx, cy).
+type placement struct {
+	cx, cy float64
+	w, h   int
+	angle  float64
+}
+
+// facePlacement picks the avatar placement for a face. In landmark mode the
+// avatar's template eyes are mapped onto the detected eyes; faces without
+// landmarks fall back to the box, rotated by the detected roll if known.
+func facePlacement(face model.Face, avatarBounds image.Rectangle, align string) placement {
+	box := face.Coordinates
+	p := placement{
+		cx: float64(box.X1+box.X2) / 2,
+		cy: float64(box.Y1+box.Y2) / 2,
+		w:  box.X2 - box.X1,
+		h:  box.Y2 - box.Y1,
+	}
+
+	if align != AlignLandmarks {
+		return p
+	}
+
+	if lm := face.Landmarks; lm != nil {
+		// Order by x so the result doesn't depend on whose "left" the API means
+		left, right := lm.LeftEye, lm.RightEye
+		if left.X > right.X {
+			left, right = right, left
+		}
+		dx := float64(right.X - left.X)
+		dy := float64(right.Y - left.Y)
+		eyeDist := math.Hypot(dx, dy)
+
+		if eyeDist >= 2 && avatarBounds.Dx() > 0 {
+			scale := eyeDist / (templateEyeSpacing * float64(avatarBounds.Dx()))
+			p.w = int(float64(avatarBounds.Dx())*scale + 0.5)
+			p.h = int(float64(avatarBounds.Dy())*scale + 0.5)
+			p.angle = math.Atan2(dy, dx)
+
+			// The eye midpoint sits above the avatar centre by (0.5 - templateEyeY) * h
+			midX := float64(left.X+right.X) / 2
+			midY := float64(left.Y+right.Y) / 2
+			offset := (0.5 - templateEyeY) * float64(p.h)
+			p.cx = midX - offset*math.Sin(p.angle)
+			p.cy = midY + offset*math.Cos(p.angle)
+			return p
+		}
+	}
+
+	if face.Pose != nil {
+		p.angle = float64(face.Pose.Roll) * math.Pi / 180
+	}
+	return p
+}
+
+// bounds returns the photo-space bounding box of the rotated avatar rectangle
+func (p placement) bounds() image.Rectangle {
+	sin, cos := math.Sincos(p.angle)
+	halfW, halfH := float64(p.w)/2, float64(p.h)/2
+	extX := math.Abs(halfW*cos) + math.Abs(halfH*sin)
+	extY := math.Abs(halfW*sin) + math.Abs(halfH*cos)
+	return image.Rect(
+		int(math.Floor(p.cx-extX)), int(math.Floor(p.cy-extY)),
+		int(math.Ceil(p.cx+extX)), int(math.Ceil(p.cy+extY)),
+	)
+}
+
+// inverse returns a function mapping a photo pixel to avatar coordinates;
+// ok is false when the pixel centre falls outside the avatar.
+func (p placement) inverse() func(x, y int) (ax, ay float64, ok bool) {
+	sin, cos := math.Sincos(p.angle)
+	halfW, halfH := float64(p.w)/2, float64(p.h)/2
+	return func(x, y int) (float64, float64, bool) {
+		dx, dy := float64(x)+0.5-p.cx, float64(y)+0.5-p.cy
+		ax := dx*cos + dy*sin + halfW
+		ay := -dx*sin + dy*cos + halfH
+		ok := ax >= 0 && ay >= 0 && ax < float64(p.w) && ay < float64(p.h)
+		return ax, ay, ok
+	}
+}
+
+// pasteAvatar blends an avatar already scaled to p.w x p.h into the canvas,
+// rotated by p.angle, using mask as per-pixel opacity.
+func pasteAvatar(canvas *image.RGBA, avatar *image.RGBA, mask *image.Alpha, p placement) {
+	area := p.bounds().Intersect(canvas.Bounds())
+	toAvatar := p.inverse()
+
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			ax, ay, ok := toAvatar(x, y)
+			if !ok {
+				continue
+			}
+
+			m := float64(mask.Pix[int(ay)*mask.Stride+int(ax)]) / 255
+			if m == 0 {
+				continue
+			}
+
+			r, g, b, a := sampleBilinear(avatar, ax-0.5, ay-0.5)
+			alpha := a * m
+			if alpha == 0 {
+				continue
+			}
+
+			i := canvas.PixOffset(x, y)
+			px := canvas.Pix[i : i+4 : i+4]
+			px[0] = uint8(r*m + float64(px[0])*(1-alpha) + 0.5)
+			px[1] = uint8(g*m + float64(px[1])*(1-alpha) + 0.5)
+			px[2] = uint8(b*m + float64(px[2])*(1-alpha) + 0.5)
+			px[3] = uint8(255*alpha + float64(px[3])*(1-alpha) + 0.5)
+		}
+	}
+}
+
+// sampleBilinear returns premultiplied r, g, b in [0,255] and alpha in [0,1]
+// at a fractional pixel position, clamping at the image edges.
+func sampleBilinear(img *image.RGBA, fx, fy float64) (r, g, b, a float64) {
+	bounds := img.Bounds()
+	x0 := int(math.Floor(fx))
+	y0 := int(math.Floor(fy))
+	tx, ty := fx-float64(x0), fy-float64(y0)
+
+	clampX := func(x int) int { return min(max(x, bounds.Min.X), bounds.Max.X-1) }
+	clampY := func(y int) int { return min(max(y, bounds.Min.Y), bounds.Max.Y-1) }
+
+	var sum [4]float64
+	for _, s := range [4]struct {
+		x, y int
+		w    float64
+	}{
+		{x0, y0, (1 - tx) * (1 - ty)},
+		{x0 + 1, y0, tx * (1 - ty)},
+		{x0, y0 + 1, (1 - tx) * ty},
+		{x0 + 1, y0 + 1, tx * ty},
+	} {
+		i := img.PixOffset(clampX(s.x), clampY(s.y))
+		for c := 0; c < 4; c++ {
+			sum[c] += float64(img.Pix[i+c]) * s.w
+		}
+	}
+	return sum[0], sum[1], sum[2], sum[3] / 255
+}
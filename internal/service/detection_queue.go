@@ -0,0 +1,167 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// detectionPollInterval is how often idle workers look for jobs they were not
+// woken up for (e.g. requeued after a failure)
+const detectionPollInterval = 5 * time.Second
+
+// Failed attempts are retried after detectionRetryDelay, doubled for every
+// further attempt up to detectionRetryMaxDelay
+const (
+	detectionRetryDelay    = 30 * time.Second
+	detectionRetryMaxDelay = 10 * time.Minute
+)
+
+// detectionWake nudges an idle worker when a job is queued
+var detectionWake = make(chan struct{}, 1)
+
+// StartDetectionWorkers requeues jobs left running by a previous process and
+// starts a fixed pool of workers that run queued face detection jobs.
+func StartDetectionWorkers(cfg *config.Config) error {
+	n, err := repository.RequeueRunningDetectionJobs()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("[DetectionQueue] Requeued %d interrupted jobs", n)
+	}
+
+	workers := max(cfg.DetectionWorkers, 1)
+	for i := 0; i < workers; i++ {
+		go detectionWorker(cfg)
+	}
+	log.Printf("[DetectionQueue] Started %d workers", workers)
+
+	wakeDetectionWorker()
+	return nil
+}
+
+// EnqueueDetection queues face detection for the event's current picture.
+// mode is model.JobModeReplace after an upload, or model.JobModeMerge to
+// re-run detection while keeping manual faces and avatars.
+func EnqueueDetection(eventID int, mode string) (int64, error) {
+	id, err := repository.CreateDetectionJob(eventID, mode)
+	if err != nil {
+		return 0, err
+	}
+	wakeDetectionWorker()
+	return id, nil
+}
+
+func wakeDetectionWorker() {
+	select {
+	case detectionWake <- struct{}{}:
+	default:
+	}
+}
+
+func detectionWorker(cfg *config.Config) {
+	ticker := time.NewTicker(detectionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := repository.ClaimDetectionJob()
+		if err != nil {
+			log.Printf("[DetectionQueue] Failed to claim job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-detectionWake:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		// There may be more work queued; let another idle worker look
+		wakeDetectionWorker()
+		runDetectionJob(job, cfg)
+	}
+}
+
+func runDetectionJob(job *model.DetectionJob, cfg *config.Config) {
+	jobID, eventID, attempt, maxAttempts := job.ID, job.EventID, job.Attempts, cfg.DetectionMaxAttempts
+	log.Printf("[DetectionQueue] Job %d: event %d, %s, attempt %d/%d", jobID, eventID, job.Mode, attempt, maxAttempts)
+
+	var result *DetectFacesResult
+	var report []byte
+	event, err := repository.GetEventByID(eventID)
+	if err == nil && event == nil {
+		err = ErrEventDeleted
+	}
+	var detector FaceDetector
+	if err == nil {
+		// AnalyzeFace is billed per face, so landmarks are only fetched for
+		// events whose composite is aligned by them
+		jobCfg := *cfg
+		jobCfg.DetectLandmarks = cfg.DetectLandmarks && event.Composite.Align == AlignLandmarks
+		detector, err = NewFaceDetector(&jobCfg)
+	}
+	if err == nil {
+		if job.Mode == model.JobModeMerge {
+			var merge *ReprocessReport
+			result, merge, err = ReprocessEventImage(detector, eventID, event.Detection)
+			if err == nil {
+				report, err = json.Marshal(merge)
+			}
+		} else {
+			result, err = ProcessEventImage(detector, eventID, event.Detection)
+		}
+	}
+
+	if err != nil {
+		requeue := attempt < maxAttempts && !permanentDetectionError(err)
+		var dbErr error
+		if requeue {
+			delay := min(detectionRetryDelay<<(attempt-1), detectionRetryMaxDelay)
+			log.Printf("[DetectionQueue] Job %d failed, retrying in %v: %v", jobID, delay, err)
+			dbErr = repository.RetryDetectionJob(jobID, err.Error(), delay)
+		} else {
+			log.Printf("[DetectionQueue] Job %d failed: %v", jobID, err)
+			dbErr = repository.FailDetectionJob(jobID, err.Error())
+		}
+		if dbErr != nil {
+			log.Printf("[DetectionQueue] Failed to update job %d: %v", jobID, dbErr)
+		}
+		if !requeue {
+			LogActivity("ERROR", "图片处理", "人脸识别失败", "", strconv.Itoa(eventID), "", map[string]any{
+				"job_id":   jobID,
+				"mode":     job.Mode,
+				"attempts": attempt,
+				"error":    err.Error(),
+			})
+		}
+		return
+	}
+
+	if err := repository.CompleteDetectionJob(jobID, len(result.Faces), report); err != nil {
+		log.Printf("[DetectionQueue] Failed to update job %d: %v", jobID, err)
+	}
+	LogActivity("INFO", "图片处理", "人脸识别完成", "", strconv.Itoa(eventID), "", map[string]any{
+		"job_id":      jobID,
+		"mode":        job.Mode,
+		"faces_count": len(result.Faces),
+	})
+}
+
+// permanentDetectionError reports whether another attempt would fail the same
+// way: the event is gone, its picture is missing or unreadable, or Tencent
+// refused the request for a reason a retry cannot fix. A new upload queues a
+// new job.
+func permanentDetectionError(err error) bool {
+	return errors.Is(err, ErrEventDeleted) ||
+		errors.Is(err, ErrImageUndecodable) ||
+		errors.Is(err, storage.ErrNotFound) ||
+		errors.Is(err, ErrTencentPermanent)
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"fmt"
+
+	"avatar-face-swap-go/internal/model"
+)
+
+// Detection defaults, used for events that never changed their settings
+const (
+	defaultMaxFaceNum   = 120
+	defaultMinFaceSize  = 34
+	defaultModelVersion = "3.0"
+	defaultPadding      = 10
+)
+
+// Padding units
+const (
+	PaddingPixels  = "px"
+	PaddingPercent = "percent"
+)
+
+const (
+	maxFaceNumLimit = 120 // Tencent's limit per call
+	maxPaddingPx    = 500
+)
+
+// ValidateDetectionSettings checks user-supplied detection settings and fills in defaults
+func ValidateDetectionSettings(s *model.DetectionSettings) error {
+	*s = withDetectionDefaults(*s)
+
+	if s.MaxFaceNum < 1 || s.MaxFaceNum > maxFaceNumLimit {
+		return fmt.Errorf("max_face_num must be between 1 and %d", maxFaceNumLimit)
+	}
+	if s.MinFaceSize < 1 {
+		return fmt.Errorf("min_face_size must be positive")
+	}
+
+	switch s.ModelVersion {
+	case "2.0", "3.0":
+	default:
+		return fmt.Errorf("invalid model_version %q", s.ModelVersion)
+	}
+
+	switch s.PaddingUnit {
+	case PaddingPixels:
+		if *s.Padding < 0 || *s.Padding > maxPaddingPx {
+			return fmt.Errorf("padding must be between 0 and %d px", maxPaddingPx)
+		}
+	case PaddingPercent:
+		if *s.Padding < 0 || *s.Padding > 100 {
+			return fmt.Errorf("padding must be between 0 and 100 percent")
+		}
+	default:
+		return fmt.Errorf("invalid padding_unit %q", s.PaddingUnit)
+	}
+
+	if s.MinQuality < 0 || s.MinQuality > 100 {
+		return fmt.Errorf("min_quality must be between 0 and 100")
+	}
+	return nil
+}
+
+// withDetectionDefaults fills unset fields with the built-in defaults
+func withDetectionDefaults(s model.DetectionSettings) model.DetectionSettings {
+	if s.MaxFaceNum == 0 {
+		s.MaxFaceNum = defaultMaxFaceNum
+	}
+	if s.MinFaceSize == 0 {
+		s.MinFaceSize = defaultMinFaceSize
+	}
+	if s.ModelVersion == "" {
+		s.ModelVersion = defaultModelVersion
+	}
+	if s.Padding == nil {
+		padding := defaultPadding
+		s.Padding = &padding
+	}
+	if s.PaddingUnit == "" {
+		s.PaddingUnit = PaddingPixels
+	}
+	return s
+}
+
+// facePadding returns the horizontal and vertical crop margin for a face
+func facePadding(s model.DetectionSettings, width, height int) (int, int) {
+	if s.PaddingUnit == PaddingPercent {
+		return width * *s.Padding / 100, height * *s.Padding / 100
+	}
+	return *s.Padding, *s.Padding
+}
+
+// IsLowQuality reports whether a face scored below the threshold. Faces without
+// a quality score (manual faces, offline detectors) are never low quality.
+func IsLowQuality(face model.Face, minQuality int) bool {
+	return minQuality > 0 && face.Quality != nil && face.Quality.Score < minQuality
+}
@@ -0,0 +1,445 @@
+package service
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// ArchiveVersion is the manifest format written by ExportEvent. Importers
+// accept every version up to their own. Version 2 added avatar versions.
+const ArchiveVersion = 2
+
+const archiveManifestName = "manifest.json"
+
+// ErrInvalidArchive wraps every reason an archive is rejected by ImportEvent
+var ErrInvalidArchive = errors.New("invalid event archive")
+
+// ArchiveManifest describes an exported event. Files lists the archive
+// entries besides the manifest, relative to the event directory.
+type ArchiveManifest struct {
+	Version    int              `json:"version"`
+	ExportedAt string           `json:"exported_at"`
+	Event      ArchiveEvent     `json:"event"`
+	ImageInfo  *model.ImageInfo `json:"image_info,omitempty"` // nil until the picture was processed
+	Faces      []model.Face     `json:"faces"`
+	Avatars    []ArchiveAvatar  `json:"avatars"`
+	Files      []string         `json:"files"`
+}
+
+// ArchiveEvent is the part of the event row that travels with an archive;
+// ID, token and creator are assigned again on import
+type ArchiveEvent struct {
+	Description string                  `json:"description"`
+	EventDate   string                  `json:"event_date"`
+	IsOpen      bool                    `json:"is_open"`
+	Composite   model.CompositeSettings `json:"composite"`
+	Detection   model.DetectionSettings `json:"detection"`
+}
+
+// ArchiveAvatar is an avatar version record, including its QQ binding. The
+// uploader's IP address stays behind.
+type ArchiveAvatar struct {
+	Face       string `json:"face"`
+	Filename   string `json:"filename"`
+	Source     string `json:"source"`
+	QQNumber   string `json:"qq_number,omitempty"`
+	Version    int    `json:"version"`
+	Current    bool   `json:"current"`
+	UploadedBy string `json:"uploaded_by,omitempty"`
+	CreatedAt  string `json:"created_at,omitempty"`
+}
+
+// ExportEvent writes the event as a zip archive: the picture, face crops and
+// avatars, plus a manifest with the event settings, faces and avatar records.
+// The records and file list are read under the event lock; the files are
+// streamed afterwards so a slow download doesn't block edits.
+func ExportEvent(eventID int, w io.Writer) error {
+	manifest, keys, err := snapshotEvent(eventID)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	prefix := storage.EventPrefix(eventID)
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		err := copyToArchive(zw, key, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Replaced or deleted since the snapshot. The records may still
+			// name it; the importer doesn't require their files to be present.
+			log.Printf("[Archive] Event %d: %s disappeared during export", eventID, name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, name)
+	}
+
+	// The manifest goes last so it lists the files actually written
+	mw, err := zw.Create(archiveManifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func snapshotEvent(eventID int) (*ArchiveManifest, []string, error) {
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	event, err := repository.GetEventByID(eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if event == nil {
+		return nil, nil, ErrEventDeleted
+	}
+
+	manifest := &ArchiveManifest{
+		Version:    ArchiveVersion,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Event: ArchiveEvent{
+			Description: event.Description,
+			EventDate:   event.EventDate,
+			IsOpen:      event.IsOpen,
+			Composite:   event.Composite,
+			Detection:   event.Detection,
+		},
+		Faces:   []model.Face{},
+		Avatars: []ArchiveAvatar{},
+		Files:   []string{},
+	}
+
+	if manifest.ImageInfo, err = repository.GetEventPicture(eventID); err != nil {
+		return nil, nil, err
+	}
+	faces, err := repository.GetFaces(eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest.Faces = append(manifest.Faces, faces...)
+
+	avatars, err := repository.GetAllAvatarVersions(eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range avatars {
+		manifest.Avatars = append(manifest.Avatars, ArchiveAvatar{
+			Face:       a.Face,
+			Filename:   a.Filename,
+			Source:     a.Source,
+			QQNumber:   a.QQNumber,
+			Version:    a.Version,
+			Current:    a.Current,
+			UploadedBy: a.UploadedBy,
+			CreatedAt:  a.CreatedAt,
+		})
+	}
+
+	// Composites are a cache and are rendered again after import
+	keys := []string{}
+	if storage.Exists(storage.OriginalKey(eventID)) {
+		keys = append(keys, storage.OriginalKey(eventID))
+	}
+	for _, prefix := range []string{storage.FacesPrefix(eventID), storage.AvatarsPrefix(eventID)} {
+		objects, err := storage.List(prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+	}
+	return manifest, keys, nil
+}
+
+func copyToArchive(zw *zip.Writer, key, name string) error {
+	r, err := storage.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// ImportEvent recreates an exported event under a new ID and a new random
+// token. The archive is checked as a whole before anything is written; if
+// writing fails halfway the partial event is removed again.
+func ImportEvent(zr *zip.Reader, creator string) (*model.Event, error) {
+	manifest, entries, err := readArchive(zr)
+	if err != nil {
+		return nil, err
+	}
+	size, err := archiveSize(manifest, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newEventToken()
+	if err != nil {
+		return nil, err
+	}
+	id, err := repository.CreateEvent(&model.CreateEventRequest{
+		Description: manifest.Event.Description,
+		Token:       token,
+		EventDate:   manifest.Event.EventDate,
+		IsOpen:      manifest.Event.IsOpen,
+	}, creator)
+	if err != nil {
+		return nil, err
+	}
+	eventID := int(id)
+
+	if err := importEventContent(eventID, manifest, entries, size); err != nil {
+		if _, cleanErr := storage.DeletePrefix(storage.EventPrefix(eventID)); cleanErr != nil {
+			log.Printf("[Archive] Failed to clean up files of event %d: %v", eventID, cleanErr)
+		}
+		if cleanErr := repository.DeleteEvent(eventID); cleanErr != nil {
+			log.Printf("[Archive] Failed to clean up event %d: %v", eventID, cleanErr)
+		}
+		return nil, err
+	}
+
+	log.Printf("[Archive] Imported event %d: %d files, %d faces, %d avatars",
+		eventID, len(manifest.Files), len(manifest.Faces), len(manifest.Avatars))
+	return repository.GetEventByID(eventID)
+}
+
+func importEventContent(eventID int, manifest *ArchiveManifest, entries map[string]*zip.File, size int64) error {
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	if err := CheckUploadQuota(eventID, size); err != nil {
+		return err
+	}
+
+	err := repository.UpdateEvent(eventID, &model.UpdateEventRequest{
+		Composite: &manifest.Event.Composite,
+		Detection: &manifest.Event.Detection,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range manifest.Files {
+		if err := copyFromArchive(entries[name], storage.EventPrefix(eventID)+name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if manifest.ImageInfo != nil {
+		err := saveMetadata(eventID, &DetectFacesResult{ImageInfo: *manifest.ImageInfo, Faces: manifest.Faces})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range manifest.Avatars {
+		err := repository.AddAvatarVersion(&model.Avatar{
+			EventID:    eventID,
+			Face:       a.Face,
+			Filename:   a.Filename,
+			Source:     a.Source,
+			QQNumber:   a.QQNumber,
+			Version:    a.Version,
+			Current:    a.Current,
+			UploadedBy: a.UploadedBy,
+			CreatedAt:  a.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFromArchive stores an archive entry. An entry that inflates past its
+// declared size is cut off there, so the quota checked against the declared
+// sizes holds.
+func copyFromArchive(f *zip.File, key string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return storage.Put(key, io.LimitReader(r, int64(f.UncompressedSize64)))
+}
+
+// archiveSize adds up the declared uncompressed sizes of the files an import
+// writes
+func archiveSize(manifest *ArchiveManifest, entries map[string]*zip.File) (int64, error) {
+	var total uint64
+	for _, name := range manifest.Files {
+		size := entries[name].UncompressedSize64
+		if size > math.MaxInt64-total {
+			return 0, fmt.Errorf("%w: files too large", ErrInvalidArchive)
+		}
+		total += size
+	}
+	return int64(total), nil
+}
+
+// readArchive parses and checks the manifest and returns the archive entries
+// by name. Every entry must be the manifest, the picture, or a plain file in
+// faces/ or avatars/; anything else, including names that try to leave the
+// event directory, rejects the archive.
+func readArchive(zr *zip.Reader) (*ArchiveManifest, map[string]*zip.File, error) {
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue // directory entries written by some zip tools
+		}
+		if !validArchiveEntry(f.Name) {
+			return nil, nil, fmt.Errorf("%w: unexpected entry %q", ErrInvalidArchive, f.Name)
+		}
+		if entries[f.Name] != nil {
+			return nil, nil, fmt.Errorf("%w: duplicate entry %q", ErrInvalidArchive, f.Name)
+		}
+		entries[f.Name] = f
+	}
+
+	mf := entries[archiveManifestName]
+	if mf == nil {
+		return nil, nil, fmt.Errorf("%w: %s missing", ErrInvalidArchive, archiveManifestName)
+	}
+	r, err := mf.Open()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer r.Close()
+
+	var manifest ArchiveManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("%w: bad manifest: %v", ErrInvalidArchive, err)
+	}
+	if err := checkManifest(&manifest, entries); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return &manifest, entries, nil
+}
+
+func checkManifest(m *ArchiveManifest, entries map[string]*zip.File) error {
+	if m.Version < 1 || m.Version > ArchiveVersion {
+		return fmt.Errorf("unsupported version %d", m.Version)
+	}
+	if m.Event.Description == "" || m.Event.EventDate == "" {
+		return errors.New("event description and date are required")
+	}
+	if err := ValidateCompositeSettings(&m.Event.Composite); err != nil {
+		return err
+	}
+	if err := ValidateDetectionSettings(&m.Event.Detection); err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool, len(m.Files))
+	for _, name := range m.Files {
+		if name == archiveManifestName || entries[name] == nil {
+			return fmt.Errorf("file %q not in archive", name)
+		}
+		listed[name] = true
+	}
+	for name := range entries {
+		if name != archiveManifestName && !listed[name] {
+			return fmt.Errorf("entry %q not listed in manifest", name)
+		}
+	}
+
+	if len(m.Faces) > 0 && m.ImageInfo == nil {
+		return errors.New("faces without image_info")
+	}
+	faces := make(map[string]bool, len(m.Faces))
+	for _, f := range m.Faces {
+		if !plainFileName(f.Filename) || faces[f.Filename] {
+			return fmt.Errorf("invalid face %q", f.Filename)
+		}
+		faces[f.Filename] = true
+	}
+	// Version 1 archives hold only the avatar in use, one per face
+	if m.Version < 2 {
+		for i := range m.Avatars {
+			m.Avatars[i].Version, m.Avatars[i].Current = 1, true
+		}
+	}
+	versions := map[string]map[int]bool{}
+	current := map[string]int{}
+	for _, a := range m.Avatars {
+		if !faces[a.Face] {
+			return fmt.Errorf("avatar of unknown face %q", a.Face)
+		}
+		if versions[a.Face] == nil {
+			versions[a.Face] = map[int]bool{}
+		}
+		if a.Version < 1 || versions[a.Face][a.Version] {
+			return fmt.Errorf("invalid avatar version %d of face %q", a.Version, a.Face)
+		}
+		versions[a.Face][a.Version] = true
+		if a.Current {
+			current[a.Face]++
+		}
+		if !plainFileName(a.Filename) {
+			return fmt.Errorf("invalid avatar file %q", a.Filename)
+		}
+		if a.Source != model.AvatarSourceUpload && a.Source != model.AvatarSourceQQ {
+			return fmt.Errorf("invalid avatar source %q", a.Source)
+		}
+	}
+	for face := range versions {
+		if current[face] != 1 {
+			return fmt.Errorf("face %q needs exactly one current avatar, has %d", face, current[face])
+		}
+	}
+	return nil
+}
+
+// validArchiveEntry reports whether name is one of the entries an event
+// archive may contain, rejecting absolute paths, backslashes and ".." elements
+func validArchiveEntry(name string) bool {
+	if strings.Contains(name, "\\") || path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+	if name == archiveManifestName || name == "original.jpg" {
+		return true
+	}
+	dir, file := path.Split(name)
+	return (dir == "faces/" || dir == "avatars/") && plainFileName(file)
+}
+
+// plainFileName reports whether name is a single path element
+func plainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+func newEventToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -2,259 +2,204 @@ package service
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	_ "image/png"
+	"io"
 	"log"
-	"os"
+	"time"
 
-	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
 	"avatar-face-swap-go/internal/storage"
 
 	"golang.org/x/image/draw"
-
-	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
-	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
-	iai "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/iai/v20200303"
 )
 
-type FaceDetectionResult struct {
-	Filename    string         `json:"filename"`
-	Coordinates FaceCoordinate `json:"coordinates"`
-	Confidence  float64        `json:"confidence,omitempty"`
-}
-
-type FaceCoordinate struct {
-	X1 int `json:"x1"`
-	Y1 int `json:"y1"`
-	X2 int `json:"x2"`
-	Y2 int `json:"y2"`
-}
-
 type DetectFacesResult struct {
-	ImageInfo ImageInfo             `json:"image_info"`
-	Faces     []FaceDetectionResult `json:"faces"`
+	ImageInfo model.ImageInfo `json:"image_info"`
+	Faces     []model.Face    `json:"faces"`
 }
 
-type ImageInfo struct {
-	Width    int    `json:"width"`
-	Height   int    `json:"height"`
-	Filename string `json:"filename"`
-}
+// DetectFaces runs the detector on a stored image and turns the raw boxes into
+// padded, clamped face crops in original image coordinates.
+func DetectFaces(detector FaceDetector, imageKey string, settings model.DetectionSettings) (*DetectFacesResult, error) {
+	settings = withDetectionDefaults(settings)
 
-func DetectFaces(imagePath string) (*DetectFacesResult, error) {
-	cfg := config.Load()
+	log.Printf("[FaceDetection] Starting %s detection for: %s", detector.Name(), imageKey)
 
-	log.Printf("[FaceDetection] Starting detection for: %s", imagePath)
-
-	if cfg.TencentSecretID == "" || cfg.TencentSecretKey == "" {
-		return nil, fmt.Errorf("Tencent Cloud credentials not configured")
-	}
-
-	log.Printf("[FaceDetection] Credentials loaded, SecretID prefix: %s...", cfg.TencentSecretID[:10])
-
-	// Read and encode image
-	imageData, err := os.ReadFile(imagePath)
+	imageData, err := storage.ReadFile(imageKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read image: %w", err)
 	}
 
 	log.Printf("[FaceDetection] Image size: %d bytes", len(imageData))
 
-	// Decode image to check dimensions
 	img, _, err := image.Decode(bytes.NewReader(imageData))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrImageUndecodable, err)
 	}
 
 	bounds := img.Bounds()
 	origWidth, origHeight := bounds.Dx(), bounds.Dy()
 	log.Printf("[FaceDetection] Original dimensions: %dx%d", origWidth, origHeight)
 
-	// Tencent API limits: JPG max 4000px, others max 2000px on long edge
-	maxEdge := 4000
-	longEdge := max(origWidth, origHeight)
-
-	var scale float64 = 1.0
-	if longEdge > maxEdge {
-		scale = float64(maxEdge) / float64(longEdge)
-		newWidth := int(float64(origWidth) * scale)
-		newHeight := int(float64(origHeight) * scale)
-		log.Printf("[FaceDetection] Resizing to %dx%d (scale: %.2f)", newWidth, newHeight, scale)
+	detected, err := detector.Detect(DetectRequest{
+		ImageKey: imageKey,
+		Data:     imageData,
+		Image:    img,
 
-		img = resizeImage(img, newWidth, newHeight)
-
-		// Re-encode to JPEG
-		var buf bytes.Buffer
-		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
-			return nil, fmt.Errorf("failed to encode resized image: %w", err)
-		}
-		imageData = buf.Bytes()
-		log.Printf("[FaceDetection] Resized image size: %d bytes", len(imageData))
-	}
-
-	// Check if image is too large (5MB limit for base64)
-	if len(imageData) > 5*1024*1024 {
-		return nil, fmt.Errorf("image too large: %d bytes (max 5MB)", len(imageData))
-	}
-
-	imageBase64 := base64.StdEncoding.EncodeToString(imageData)
-
-	// Create Tencent Cloud client
-	credential := common.NewCredential(cfg.TencentSecretID, cfg.TencentSecretKey)
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "iai.tencentcloudapi.com"
-
-	client, err := iai.NewClient(credential, cfg.TencentRegion, cpf)
+		MaxFaces:     settings.MaxFaceNum,
+		MinFaceSize:  settings.MinFaceSize,
+		ModelVersion: settings.ModelVersion,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Tencent client: %w", err)
+		return nil, err
 	}
 
-	// Build request
-	request := iai.NewDetectFaceRequest()
-	maxFaceNum := uint64(120)
-	minFaceSize := uint64(34)
-	faceModelVersion := "3.0"
-
-	request.Image = &imageBase64
-	request.MaxFaceNum = &maxFaceNum
-	request.MinFaceSize = &minFaceSize
-	request.FaceModelVersion = &faceModelVersion
-
-	// Call API
-	log.Printf("[FaceDetection] Calling Tencent API...")
-	response, err := client.DetectFace(request)
-	if err != nil {
-		log.Printf("[FaceDetection] API call failed: %v", err)
-		return nil, fmt.Errorf("Tencent API error: %w", err)
-	}
-
-	log.Printf("[FaceDetection] API call successful, found %d faces", len(response.Response.FaceInfos))
-
 	// Parse result - use ORIGINAL dimensions for metadata
 	result := &DetectFacesResult{
-		ImageInfo: ImageInfo{
+		ImageInfo: model.ImageInfo{
 			Width:    origWidth,
 			Height:   origHeight,
 			Filename: "original.jpg",
 		},
-		Faces: make([]FaceDetectionResult, 0),
+		Faces: make([]model.Face, 0),
 	}
 
-	apiWidth := int(*response.Response.ImageWidth)
-	apiHeight := int(*response.Response.ImageHeight)
-
-	for i, face := range response.Response.FaceInfos {
-		x := int(*face.X)
-		y := int(*face.Y)
-		w := int(*face.Width)
-		h := int(*face.Height)
-
-		// Scale coordinates back to original image size
-		if scale < 1.0 {
-			x = int(float64(x) / scale)
-			y = int(float64(y) / scale)
-			w = int(float64(w) / scale)
-			h = int(float64(h) / scale)
-		}
-
-		// Add padding (scaled)
-		padding := 10
-		if scale < 1.0 {
-			padding = int(float64(padding) / scale)
-		}
-		x1 := max(0, x-padding)
-		y1 := max(0, y-padding)
-		x2 := min(origWidth, x+w+padding)
-		y2 := min(origHeight, y+h+padding)
+	for i, face := range detected {
+		// Add padding
+		padX, padY := facePadding(settings, face.Width, face.Height)
+		x1 := max(0, face.X-padX)
+		y1 := max(0, face.Y-padY)
+		x2 := min(origWidth, face.X+face.Width+padX)
+		y2 := min(origHeight, face.Y+face.Height+padY)
 
-		log.Printf("[FaceDetection] Face %d: API coords (%d,%d,%d,%d) -> Original coords (%d,%d,%d,%d)",
-			i+1, int(*face.X), int(*face.Y), int(*face.Width), int(*face.Height), x1, y1, x2, y2)
+		log.Printf("[FaceDetection] Face %d: detected (%d,%d,%d,%d) -> crop (%d,%d,%d,%d)",
+			i+1, face.X, face.Y, face.Width, face.Height, x1, y1, x2, y2)
 
-		result.Faces = append(result.Faces, FaceDetectionResult{
+		faceResult := model.Face{
 			Filename: fmt.Sprintf("face_%d.jpg", i+1),
-			Coordinates: FaceCoordinate{
+			Coordinates: model.FaceCoordinate{
 				X1: x1,
 				Y1: y1,
 				X2: x2,
 				Y2: y2,
 			},
-			Confidence: 1.0,
-		})
+			Landmarks: face.Landmarks,
+			Pose:      face.Pose,
+			Quality:   face.Quality,
+		}
+		// Confidence is only known when the detector rated the face
+		if face.Quality != nil {
+			faceResult.Confidence = float64(face.Quality.Score) / 100
+		}
+		result.Faces = append(result.Faces, faceResult)
 	}
 
-	_ = apiWidth // suppress unused warning
-	_ = apiHeight
-
 	return result, nil
 }
 
-func ProcessEventImage(eventID int, imagePath string) error {
-	log.Printf("[ProcessEventImage] Starting for event %d, path: %s", eventID, imagePath)
+// ProcessEventImage detects faces in the event picture, saves a crop of each
+// face and stores the faces in the database. It returns the saved metadata.
+func ProcessEventImage(detector FaceDetector, eventID int, settings model.DetectionSettings) (*DetectFacesResult, error) {
+	imageKey := storage.OriginalKey(eventID)
+	log.Printf("[ProcessEventImage] Starting for event %d, key: %s", eventID, imageKey)
 
 	// Detect faces
-	result, err := DetectFaces(imagePath)
+	result, err := DetectFaces(detector, imageKey, settings)
 	if err != nil {
 		log.Printf("[ProcessEventImage] DetectFaces failed: %v", err)
-		return err
+		return nil, err
 	}
 
 	log.Printf("[ProcessEventImage] Detected %d faces", len(result.Faces))
 
-	// Ensure directories exist
-	if err := storage.EnsureEventDirs(eventID); err != nil {
-		return err
-	}
-
 	// Open original image for cropping
-	file, err := os.Open(imagePath)
+	img, err := decodeImage(imageKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
 
-	img, _, err := image.Decode(file)
-	if err != nil {
-		return err
+	// Detection ran unlocked; the files and faces are replaced in one go
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+	if err := checkEventLive(eventID); err != nil {
+		return nil, err
+	}
+	if err := releasePreviousFaces(eventID); err != nil {
+		return nil, err
 	}
 
 	// Crop and save each face
-	for _, face := range result.Faces {
-		croppedImg := cropImageRect(img, face.Coordinates.X1, face.Coordinates.Y1, face.Coordinates.X2, face.Coordinates.Y2)
+	if err := saveFaceCrops(eventID, img, result.Faces); err != nil {
+		return nil, err
+	}
 
-		facePath := storage.GetFacePath(eventID, face.Filename)
-		faceFile, err := os.Create(facePath)
-		if err != nil {
+	// Save metadata
+	if err := saveMetadata(eventID, result); err != nil {
+		return nil, err
+	}
+
+	InvalidateComposite(eventID)
+	return result, nil
+}
+
+// releasePreviousFaces clears what belonged to the faces of the previous
+// picture: a new picture shows other people under the same face_N names, so
+// their crops are deleted, claims dropped and avatars set aside like those of
+// faces a re-run removes. Callers hold the event lock.
+func releasePreviousFaces(eventID int) error {
+	faces, err := repository.GetFaces(eventID)
+	if err != nil {
+		return err
+	}
+	for _, face := range faces {
+		if err := storage.Delete(storage.FaceKey(eventID, face.Filename)); err != nil {
 			return err
 		}
+	}
 
-		if err := jpeg.Encode(faceFile, croppedImg, &jpeg.Options{Quality: 90}); err != nil {
-			faceFile.Close()
+	avatars, err := repository.GetAllAvatarVersions(eventID)
+	if err != nil {
+		return err
+	}
+	suffix := fmt.Sprintf(".removed-%d", time.Now().UnixMilli())
+	moves := map[string]string{}
+	var removed []string
+	for _, avatar := range avatars {
+		if _, ok := moves[avatar.Face]; !ok {
+			moves[avatar.Face] = faceBaseName(avatar.Face) + suffix
+			removed = append(removed, avatar.Face)
+		}
+	}
+	if len(moves) > 0 {
+		if _, err := moveAvatars(eventID, moves, removed); err != nil {
 			return err
 		}
-		faceFile.Close()
 	}
 
-	// Copy original to storage
-	originalDest := storage.GetOriginalPath(eventID)
-	if imagePath != originalDest {
-		srcData, err := os.ReadFile(imagePath)
+	return repository.DeleteFaceClaims(eventID)
+}
+
+// saveFaceCrops stores the crop of each face
+func saveFaceCrops(eventID int, img image.Image, faces []model.Face) error {
+	for _, face := range faces {
+		croppedImg := cropImageRect(img, face.Coordinates.X1, face.Coordinates.Y1, face.Coordinates.X2, face.Coordinates.Y2)
+
+		err := storage.Write(storage.FaceKey(eventID, face.Filename), func(w io.Writer) error {
+			return jpeg.Encode(w, croppedImg, &jpeg.Options{Quality: 90})
+		})
 		if err != nil {
 			return err
 		}
-		if err := os.WriteFile(originalDest, srcData, 0644); err != nil {
-			return err
-		}
 	}
-
-	// Save metadata
-	return saveMetadata(eventID, result)
+	return nil
 }
 
-func resizeImage(img image.Image, width, height int) image.Image {
+func resizeImage(img image.Image, width, height int) *image.RGBA {
 	dst := image.NewRGBA(image.Rect(0, 0, width, height))
 	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
 	return dst
@@ -267,29 +212,59 @@ func cropImageRect(img image.Image, x1, y1, x2, y2 int) image.Image {
 		return subImager.SubImage(image.Rect(x1, y1, x2, y2))
 	}
 
-	// Fallback
-	cropped := image.NewRGBA(image.Rect(0, 0, x2-x1, y2-y1))
+	// Fallback, keeping the source coordinates like SubImage does
+	cropped := image.NewRGBA(image.Rect(x1, y1, x2, y2))
 	for y := y1; y < y2; y++ {
 		for x := x1; x < x2; x++ {
-			cropped.Set(x-x1, y-y1, img.At(x, y))
+			cropped.Set(x, y, img.At(x, y))
 		}
 	}
 	return cropped
 }
 
+// checkEventLive fails with ErrEventDeleted once the event is in the trash, so
+// work finishing after the move doesn't write files back under the event
+func checkEventLive(eventID int) error {
+	event, err := repository.GetEventByID(eventID)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return ErrEventDeleted
+	}
+	return nil
+}
+
+// ErrImageUndecodable is returned when the event picture is not an image
+// the server can read
+var ErrImageUndecodable = errors.New("failed to decode image")
+
+// ErrMetadataNotFound is returned by LoadMetadata when the event picture has
+// not been processed yet
+var ErrMetadataNotFound = errors.New("metadata not found")
+
+// saveMetadata replaces the stored faces of an event with the detection result
 func saveMetadata(eventID int, result *DetectFacesResult) error {
-	metadataPath := storage.GetMetadataPath(eventID)
+	if err := repository.ReplaceFaces(eventID, result.Faces); err != nil {
+		return err
+	}
+	return repository.UpdateEventPicture(eventID, result.ImageInfo.Width, result.ImageInfo.Height)
+}
 
-	// Convert to map for JSON
-	metadata := map[string]any{
-		"image_info": result.ImageInfo,
-		"faces":      result.Faces,
+// LoadMetadata reads the face metadata saved for an event
+func LoadMetadata(eventID int) (*DetectFacesResult, error) {
+	info, err := repository.GetEventPicture(eventID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrMetadataNotFound
 	}
 
-	data, err := json.MarshalIndent(metadata, "", "    ")
+	faces, err := repository.GetFaces(eventID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return os.WriteFile(metadataPath, data, 0644)
+	return &DetectFacesResult{ImageInfo: *info, Faces: faces}, nil
 }
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/storage"
+
+	tcerr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+)
+
+// Face detection providers for config.FaceDetector
+const (
+	DetectorTencent = "tencent"
+	DetectorLocal   = "local"
+	DetectorMock    = "mock"
+)
+
+// DetectRequest is a single image handed to a FaceDetector
+type DetectRequest struct {
+	ImageKey string      // storage key of the source, empty when the image only exists in memory
+	Data     []byte      // encoded bytes of the image, nil when unavailable
+	Image    image.Image // decoded image
+
+	MaxFaces     int    // faces per call, 0 for the detector default
+	MinFaceSize  int    // smallest face edge in pixels, 0 for the detector default
+	ModelVersion string // Tencent face model, empty for the default
+}
+
+// DetectedFace is a raw detection in the pixel coordinates of the request image
+type DetectedFace struct {
+	X, Y, Width, Height int
+	Pose                *model.FacePose
+	Landmarks           *model.FaceLandmarks
+	Quality             *model.FaceQuality // nil when the detector doesn't rate faces
+}
+
+// FaceDetector finds faces in an image
+type FaceDetector interface {
+	Name() string
+	Detect(req DetectRequest) ([]DetectedFace, error)
+}
+
+// NewFaceDetector builds the provider selected by config.FaceDetector.
+// Deployments without Tencent credentials fall back to the local detector.
+// With config.TiledDetection, large images are scanned tile by tile.
+func NewFaceDetector(cfg *config.Config) (FaceDetector, error) {
+	switch cfg.FaceDetector {
+	case DetectorTencent:
+		if cfg.TencentSecretID == "" || cfg.TencentSecretKey == "" {
+			log.Printf("[FaceDetection] Tencent Cloud credentials not configured, using local detector")
+			return newLocalFaceDetector(cfg)
+		}
+		detector, err := NewTencentDetector(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.TiledDetection {
+			// Each tile is sent as is, so it must fit the API's size limit
+			return NewTiledDetector(detector, min(cfg.DetectionTileSize, tencentMaxEdge), cfg.DetectionTileOverlap), nil
+		}
+		return detector, nil
+	case DetectorLocal:
+		return newLocalFaceDetector(cfg)
+	case DetectorMock:
+		return &MockDetector{FacesFile: cfg.MockFacesFile}, nil
+	default:
+		return nil, fmt.Errorf("unknown face detector %q", cfg.FaceDetector)
+	}
+}
+
+func newLocalFaceDetector(cfg *config.Config) (FaceDetector, error) {
+	detector, err := NewLocalDetector(cfg.LocalCascadePath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TiledDetection {
+		return NewTiledDetector(detector, min(cfg.DetectionTileSize, localMaxEdge), cfg.DetectionTileOverlap), nil
+	}
+	return detector, nil
+}
+
+// MockDetector is a deterministic offline detector for development and CI.
+// It reads boxes from a JSON sidecar stored next to the image
+// ("<image>.faces.json"), falling back to the local FacesFile, and otherwise
+// reports one centred face. A sidecar of the form {"tencent_error": "<code>"}
+// fails detection with that Tencent error code instead.
+type MockDetector struct {
+	FacesFile string
+}
+
+// mockFace is the sidecar format: [{"x": 10, "y": 20, "width": 50, "height": 60}, ...]
+type mockFace struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (d *MockDetector) Name() string {
+	return DetectorMock
+}
+
+func (d *MockDetector) Detect(req DetectRequest) ([]DetectedFace, error) {
+	var data []byte
+	var source string
+	if req.ImageKey != "" {
+		sidecar, err := storage.ReadFile(req.ImageKey + ".faces.json")
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		data, source = sidecar, req.ImageKey+".faces.json"
+	}
+	if data == nil && d.FacesFile != "" {
+		file, err := os.ReadFile(d.FacesFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		data, source = file, d.FacesFile
+	}
+
+	if data != nil {
+		var boxes []mockFace
+		if err := json.Unmarshal(data, &boxes); err != nil {
+			var failure struct {
+				TencentError string `json:"tencent_error"`
+			}
+			if json.Unmarshal(data, &failure) != nil || failure.TencentError == "" {
+				return nil, fmt.Errorf("invalid mock faces file %s: %w", source, err)
+			}
+			log.Printf("[MockDetector] Failing with %s from %s", failure.TencentError, source)
+			return nil, tencentError(tcerr.NewTencentCloudSDKError(failure.TencentError, "mock detector", ""))
+		}
+
+		log.Printf("[MockDetector] Loaded %d faces from %s", len(boxes), source)
+		faces := make([]DetectedFace, 0, len(boxes))
+		for _, b := range boxes {
+			faces = append(faces, DetectedFace{X: b.X, Y: b.Y, Width: b.Width, Height: b.Height})
+		}
+		return faces, nil
+	}
+
+	// Fixed rule: one square face in the middle, a quarter of the short edge wide
+	bounds := req.Image.Bounds()
+	side := min(bounds.Dx(), bounds.Dy()) / 4
+	if side == 0 {
+		return nil, nil
+	}
+	return []DetectedFace{{
+		X:      bounds.Min.X + (bounds.Dx()-side)/2,
+		Y:      bounds.Min.Y + (bounds.Dy()-side)/2,
+		Width:  side,
+		Height: side,
+	}}, nil
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// Reasons a stored file is considered orphaned
+const (
+	OrphanEventMissing  = "event_missing"  // the event row is gone
+	OrphanFaceUnused    = "face_unused"    // a crop no face points to
+	OrphanAvatarUnused  = "avatar_unused"  // an avatar no face points to, e.g. an old extension or one set aside by reprocess
+	OrphanLegacySidecar = "legacy_sidecar" // a face_N.json QQ sidecar, imported into the database
+	OrphanReprocessTemp = "reprocess_temp" // left behind by an interrupted reprocess
+)
+
+// Orphan is a stored file that nothing in the database refers to
+type Orphan struct {
+	Key     string `json:"key"`
+	EventID int    `json:"event_id"`
+	Size    int64  `json:"size"`
+	Reason  string `json:"reason"`
+}
+
+// GCReport lists the orphans found by CollectGarbage and, unless it was a dry
+// run, how many of them were deleted
+type GCReport struct {
+	DryRun  bool     `json:"dry_run"`
+	Orphans []Orphan `json:"orphans"`
+	Bytes   int64    `json:"bytes"`
+	Deleted int      `json:"deleted"`
+}
+
+// CollectGarbage compares the stored files with the event, face and avatar
+// records and reports the files nothing refers to. Unless dryRun is set they
+// are deleted, each deletion recorded in the activity log under user and ip.
+// Files younger than minAge are left alone, so uploads in flight and avatars
+// just set aside by reprocess are never collected.
+func CollectGarbage(dryRun bool, minAge time.Duration, user, ip string) (*GCReport, error) {
+	objects, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	// Read after listing: an event created in between has no files listed yet
+	eventIDs, err := repository.GetEventIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-minAge)
+	byEvent := map[int][]storage.ObjectInfo{}
+	report := &GCReport{DryRun: dryRun, Orphans: []Orphan{}}
+
+	for _, obj := range objects {
+		key, _ := strings.CutPrefix(obj.Key, "trash/")
+		var id int
+		if _, err := fmt.Sscanf(key, "events/%d/", &id); err != nil || !strings.HasPrefix(key, storage.EventPrefix(id)) {
+			continue // not an event file
+		}
+		if obj.ModTime.After(cutoff) {
+			continue
+		}
+		if !eventIDs[id] {
+			report.Orphans = append(report.Orphans, Orphan{Key: obj.Key, EventID: id, Size: obj.Size, Reason: OrphanEventMissing})
+			continue
+		}
+		if key == obj.Key {
+			byEvent[id] = append(byEvent[id], obj)
+		}
+	}
+	if !dryRun {
+		report.Deleted += deleteOrphans(report.Orphans, user, ip)
+	}
+
+	ids := make([]int, 0, len(byEvent))
+	for id := range byEvent {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		orphans, deleted, err := collectEventGarbage(id, byEvent[id], dryRun, user, ip)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", id, err)
+		}
+		report.Orphans = append(report.Orphans, orphans...)
+		report.Deleted += deleted
+	}
+
+	for _, o := range report.Orphans {
+		report.Bytes += o.Size
+	}
+	log.Printf("[GC] %d orphaned files (%s), %d deleted, dry run: %v",
+		len(report.Orphans), formatBytes(report.Bytes), report.Deleted, dryRun)
+	return report, nil
+}
+
+// collectEventGarbage checks the live files of one event against its records.
+// The event is locked so no upload lands between the check and the deletion.
+func collectEventGarbage(eventID int, objects []storage.ObjectInfo, dryRun bool, user, ip string) ([]Orphan, int, error) {
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	// Until legacy metadata is imported its sidecars are still needed
+	if storage.Exists(storage.MetadataKey(eventID)) {
+		return nil, 0, nil
+	}
+
+	faces, err := repository.GetFaces(eventID)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Earlier versions stay referenced, they can be rolled back to
+	avatars, err := repository.GetAllAvatarVersions(eventID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	usedFaces := make(map[string]bool, len(faces))
+	for _, f := range faces {
+		usedFaces[f.Filename] = true
+	}
+	usedAvatars := make(map[string]bool, len(avatars))
+	for _, a := range avatars {
+		usedAvatars[a.Filename] = true
+	}
+
+	var orphans []Orphan
+	for _, obj := range objects {
+		dir, name := path.Split(obj.Key)
+		reason := ""
+		switch dir {
+		case storage.FacesPrefix(eventID):
+			if !usedFaces[name] {
+				reason = OrphanFaceUnused
+			}
+		case storage.AvatarsPrefix(eventID):
+			switch {
+			case usedAvatars[name]:
+			case strings.HasPrefix(name, ".reprocess-"):
+				reason = OrphanReprocessTemp
+			case path.Ext(name) == ".json":
+				reason = OrphanLegacySidecar
+			default:
+				reason = OrphanAvatarUnused
+			}
+		}
+		if reason != "" {
+			orphans = append(orphans, Orphan{Key: obj.Key, EventID: eventID, Size: obj.Size, Reason: reason})
+		}
+	}
+
+	if dryRun || len(orphans) == 0 {
+		return orphans, 0, nil
+	}
+	return orphans, deleteOrphans(orphans, user, ip), nil
+}
+
+// deleteOrphans deletes the files and records each deletion; failures are
+// logged and skipped. It returns how many were deleted.
+func deleteOrphans(orphans []Orphan, user, ip string) int {
+	deleted := 0
+	for _, o := range orphans {
+		if err := storage.Delete(o.Key); err != nil {
+			log.Printf("[GC] Failed to delete %s: %v", o.Key, err)
+			continue
+		}
+		LogActivity("INFO", "系统维护", "清理孤立文件", user, strconv.Itoa(o.EventID), ip, map[string]any{
+			"key":    o.Key,
+			"size":   o.Size,
+			"reason": o.Reason,
+		})
+		deleted++
+	}
+	return deleted
+}
+
+// StartGarbageCollector deletes orphaned files every cfg.GCIntervalHours
+func StartGarbageCollector(cfg *config.Config) {
+	if cfg.GCIntervalHours <= 0 {
+		return
+	}
+
+	interval := time.Duration(cfg.GCIntervalHours) * time.Hour
+	minAge := time.Duration(max(cfg.GCMinAgeHours, 0)) * time.Hour
+	log.Printf("[GC] Scheduled every %s", interval)
+
+	go func() {
+		for {
+			time.Sleep(interval)
+			if _, err := CollectGarbage(false, minAge, "", ""); err != nil {
+				log.Printf("[GC] Scheduled run failed: %v", err)
+			}
+		}
+	}()
+}
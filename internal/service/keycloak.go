@@ -67,7 +67,7 @@ var (
 func GetKeycloakService() *KeycloakService {
 	keycloakOnce.Do(func() {
 		keycloakInstance = &KeycloakService{
-			config: config.Load(),
+			config: config.Current(),
 			httpClient: &http.Client{
 				Timeout: 30 * time.Second,
 			},
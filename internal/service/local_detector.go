@@ -0,0 +1,301 @@
+package service
+
+import (
+	"embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Detection parameters for the local cascade, tuned for group photos
+const (
+	localMaxEdge     = 2000 // images are downscaled to this long edge before scanning
+	localMinSize     = 20
+	localMaxSize     = 1000
+	localShiftFactor = 0.1
+	localScaleFactor = 1.1
+	localIoU         = 0.2
+	localMinScore    = 5.0 // cluster score below which a detection is discarded
+)
+
+// LocalDetector is a CPU-only face detector based on pixel intensity
+// comparison trees (the pico algorithm). It uses the "facefinder" cascade
+// built into the binary unless another pico cascade file is given.
+type LocalDetector struct {
+	cascade *picoCascade
+}
+
+// embeddedCascade holds cascade/facefinder, see cascade/README.md
+//
+//go:embed cascade
+var embeddedCascade embed.FS
+
+const embeddedCascadeName = "cascade/facefinder"
+
+var (
+	cascadeCache   = map[string]*picoCascade{}
+	cascadeCacheMu sync.Mutex
+)
+
+// NewLocalDetector loads the cascade at path, or the embedded one if path is
+// empty, caching it for later calls
+func NewLocalDetector(path string) (*LocalDetector, error) {
+	cascadeCacheMu.Lock()
+	defer cascadeCacheMu.Unlock()
+
+	if cascade, ok := cascadeCache[path]; ok {
+		return &LocalDetector{cascade: cascade}, nil
+	}
+
+	key := path
+	var data []byte
+	var err error
+	if path == "" {
+		data, err = embeddedCascade.ReadFile(embeddedCascadeName)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.New("no face cascade built in, set LOCAL_CASCADE_PATH")
+		}
+		path = "(embedded) facefinder"
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read face cascade: %w", err)
+	}
+	cascade, err := parsePicoCascade(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid face cascade %s: %w", path, err)
+	}
+
+	log.Printf("[LocalDetector] Loaded cascade %s (%d trees, depth %d)", path, cascade.treeNum, cascade.treeDepth)
+	cascadeCache[key] = cascade
+	return &LocalDetector{cascade: cascade}, nil
+}
+
+func (d *LocalDetector) Name() string {
+	return DetectorLocal
+}
+
+func (d *LocalDetector) Detect(req DetectRequest) ([]DetectedFace, error) {
+	img := req.Image
+	bounds := img.Bounds()
+
+	scale := 1.0
+	if longEdge := max(bounds.Dx(), bounds.Dy()); longEdge > localMaxEdge {
+		scale = float64(localMaxEdge) / float64(longEdge)
+		img = resizeImage(img, int(float64(bounds.Dx())*scale), int(float64(bounds.Dy())*scale))
+	}
+
+	// The smallest window scanned, in the (possibly downscaled) image
+	minSize := localMinSize
+	if req.MinFaceSize > 0 {
+		minSize = max(int(float64(req.MinFaceSize)*scale), localMinSize)
+	}
+
+	gray, cols, rows := grayscale(img)
+	detections := d.cascade.run(gray, rows, cols, minSize)
+	var clusters []picoDetection
+	for _, det := range clusterDetections(detections, localIoU) {
+		if det.q >= localMinScore {
+			clusters = append(clusters, det)
+		}
+	}
+
+	// Keep the most confident faces when the caller caps the count; weak
+	// clusters are already gone so they cannot take a place
+	if req.MaxFaces > 0 && len(clusters) > req.MaxFaces {
+		sort.Slice(clusters, func(i, j int) bool { return clusters[i].q > clusters[j].q })
+		clusters = clusters[:req.MaxFaces]
+	}
+
+	faces := make([]DetectedFace, 0, len(clusters))
+	for _, det := range clusters {
+		size := float64(det.scale) / scale
+		faces = append(faces, DetectedFace{
+			X:      bounds.Min.X + int(float64(det.col)/scale-size/2),
+			Y:      bounds.Min.Y + int(float64(det.row)/scale-size/2),
+			Width:  int(size),
+			Height: int(size),
+		})
+	}
+
+	// Top-to-bottom, left-to-right, so face_N numbering is stable between runs
+	sort.Slice(faces, func(i, j int) bool {
+		if faces[i].Y != faces[j].Y {
+			return faces[i].Y < faces[j].Y
+		}
+		return faces[i].X < faces[j].X
+	})
+
+	log.Printf("[LocalDetector] Found %d faces (%d raw detections)", len(faces), len(detections))
+	return faces, nil
+}
+
+// grayscale converts an image to a row-major luminance buffer
+func grayscale(img image.Image) ([]uint8, int, int) {
+	bounds := img.Bounds()
+	cols, rows := bounds.Dx(), bounds.Dy()
+	gray := make([]uint8, cols*rows)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			gray[y*cols+x] = uint8((0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 256)
+		}
+	}
+	return gray, cols, rows
+}
+
+// picoCascade is an ensemble of binary decision trees over pixel comparisons
+type picoCascade struct {
+	treeDepth     uint32
+	treeNum       uint32
+	treeCodes     []int8
+	treePred      []float32
+	treeThreshold []float32
+}
+
+type picoDetection struct {
+	row, col, scale int
+	q               float32
+}
+
+// parsePicoCascade decodes the binary cascade format: an 8 byte header, tree
+// depth and count, then per tree its node tests, leaf predictions and threshold.
+func parsePicoCascade(data []byte) (*picoCascade, error) {
+	if len(data) < 16 {
+		return nil, fmt.Errorf("file too short")
+	}
+
+	c := &picoCascade{}
+	pos := 8
+	c.treeDepth = binary.LittleEndian.Uint32(data[pos:])
+	pos += 4
+	c.treeNum = binary.LittleEndian.Uint32(data[pos:])
+	pos += 4
+
+	if c.treeDepth == 0 || c.treeDepth > 16 {
+		return nil, fmt.Errorf("unsupported tree depth %d", c.treeDepth)
+	}
+	leaves := 1 << c.treeDepth
+	codeBytes := 4*leaves - 4
+	treeBytes := codeBytes + 4*leaves + 4
+	if uint64(len(data)-pos) < uint64(c.treeNum)*uint64(treeBytes) {
+		return nil, fmt.Errorf("truncated: %d trees declared", c.treeNum)
+	}
+
+	for t := 0; t < int(c.treeNum); t++ {
+		// Node 0 is unused so that node i's children are 2i and 2i+1
+		c.treeCodes = append(c.treeCodes, 0, 0, 0, 0)
+		for _, b := range data[pos : pos+codeBytes] {
+			c.treeCodes = append(c.treeCodes, int8(b))
+		}
+		pos += codeBytes
+
+		for i := 0; i < leaves; i++ {
+			c.treePred = append(c.treePred, math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+			pos += 4
+		}
+
+		c.treeThreshold = append(c.treeThreshold, math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+		pos += 4
+	}
+	return c, nil
+}
+
+// classify scores a square window of side s centred on (r, c); a negative
+// result means some tree rejected it.
+func (p *picoCascade) classify(r, c, s int, pixels []uint8, rows, cols int) float32 {
+	leaves := 1 << p.treeDepth
+	root := 0
+	var out float32
+
+	r *= 256
+	c *= 256
+	for i := 0; i < int(p.treeNum); i++ {
+		idx := 1
+		for j := 0; j < int(p.treeDepth); j++ {
+			code := p.treeCodes[root+4*idx : root+4*idx+4]
+			y1 := min(max((r+int(code[0])*s)>>8, 0), rows-1)
+			x1 := min(max((c+int(code[1])*s)>>8, 0), cols-1)
+			y2 := min(max((r+int(code[2])*s)>>8, 0), rows-1)
+			x2 := min(max((c+int(code[3])*s)>>8, 0), cols-1)
+
+			bit := 0
+			if pixels[y1*cols+x1] <= pixels[y2*cols+x2] {
+				bit = 1
+			}
+			idx = 2*idx + bit
+		}
+
+		out += p.treePred[leaves*i+idx-leaves]
+		if out <= p.treeThreshold[i] {
+			return -1
+		}
+		root += 4 * leaves
+	}
+	return out - p.treeThreshold[p.treeNum-1]
+}
+
+// run slides windows of increasing size, starting at minSize, over the image
+func (p *picoCascade) run(pixels []uint8, rows, cols, minSize int) []picoDetection {
+	var detections []picoDetection
+
+	for scale := minSize; scale <= min(localMaxSize, rows, cols); scale = int(float64(scale) * localScaleFactor) {
+		step := max(int(localShiftFactor*float64(scale)), 1)
+		offset := scale/2 + 1
+		for row := offset; row <= rows-offset; row += step {
+			for col := offset; col <= cols-offset; col += step {
+				if q := p.classify(row, col, scale, pixels, rows, cols); q > 0 {
+					detections = append(detections, picoDetection{row, col, scale, q})
+				}
+			}
+		}
+	}
+	return detections
+}
+
+// clusterDetections merges overlapping windows, averaging their position and
+// size and summing their scores
+func clusterDetections(detections []picoDetection, iouThreshold float64) []picoDetection {
+	assigned := make([]bool, len(detections))
+	var clusters []picoDetection
+
+	for i := range detections {
+		if assigned[i] {
+			continue
+		}
+		var r, c, s, n int
+		var q float32
+		for j := range detections {
+			if windowIoU(detections[i], detections[j]) > iouThreshold {
+				assigned[j] = true
+				r += detections[j].row
+				c += detections[j].col
+				s += detections[j].scale
+				q += detections[j].q
+				n++
+			}
+		}
+		if n > 0 {
+			clusters = append(clusters, picoDetection{r / n, c / n, s / n, q})
+		}
+	}
+	return clusters
+}
+
+func windowIoU(a, b picoDetection) float64 {
+	ar, ac, as := float64(a.row), float64(a.col), float64(a.scale)
+	br, bc, bs := float64(b.row), float64(b.col), float64(b.scale)
+
+	overRow := math.Max(0, math.Min(ar+as/2, br+bs/2)-math.Max(ar-as/2, br-bs/2))
+	overCol := math.Max(0, math.Min(ac+as/2, bc+bs/2)-math.Max(ac-as/2, bc-bs/2))
+	inter := overRow * overCol
+	return inter / (as*as + bs*bs - inter)
+}
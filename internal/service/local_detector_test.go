@@ -0,0 +1,51 @@
+package service
+
+import (
+	"image"
+	_ "image/jpeg"
+	"os"
+	"testing"
+
+	"avatar-face-swap-go/internal/config"
+)
+
+// TestLocalDetectorFallbackFindsFace builds the detector the way a deployment
+// without Tencent credentials does, so the embedded cascade is the one used.
+// testdata/face.jpg is the 320x400 portrait from pigo's testdata (MIT).
+func TestLocalDetectorFallbackFindsFace(t *testing.T) {
+	detector, err := NewFaceDetector(&config.Config{FaceDetector: DetectorTencent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detector.Name() != DetectorLocal {
+		t.Fatalf("detector is %s, want %s", detector.Name(), DetectorLocal)
+	}
+
+	f, err := os.Open("testdata/face.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faces, err := detector.Detect(DetectRequest{Image: img})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(faces) != 1 {
+		t.Fatalf("found %d faces, want 1: %v", len(faces), faces)
+	}
+
+	// The face fills the middle of the portrait, roughly 230px across
+	face := faces[0]
+	cx, cy := face.X+face.Width/2, face.Y+face.Height/2
+	if cx < 130 || cx > 190 || cy < 170 || cy > 230 {
+		t.Errorf("face centred at (%d,%d), want about (160,200)", cx, cy)
+	}
+	if face.Width < 150 || face.Width > 300 {
+		t.Errorf("face is %dpx wide, want about 230", face.Width)
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// ImportLegacyMetadata moves face metadata left in metadata.json files by
+// older versions into the database. Each imported file is renamed to
+// metadata.json.imported so the import runs once per event.
+func ImportLegacyMetadata() error {
+	objects, err := storage.List("events/")
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	for _, obj := range objects {
+		var eventID int
+		if _, err := fmt.Sscanf(obj.Key, "events/%d/metadata.json", &eventID); err != nil {
+			continue
+		}
+		if obj.Key != storage.MetadataKey(eventID) {
+			continue
+		}
+
+		event, err := repository.GetEventByID(eventID)
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			log.Printf("[MetadataImport] Skipping event %d: not in database", eventID)
+			continue
+		}
+
+		if err := importEventMetadata(eventID, obj.Key); err != nil {
+			return fmt.Errorf("event %d: %w", eventID, err)
+		}
+		if err := storage.Move(obj.Key, obj.Key+".imported"); err != nil {
+			return err
+		}
+		imported++
+	}
+
+	if imported > 0 {
+		log.Printf("[MetadataImport] Imported metadata of %d events", imported)
+	}
+	return nil
+}
+
+func importEventMetadata(eventID int, metadataKey string) error {
+	data, err := storage.ReadFile(metadataKey)
+	if err != nil {
+		return err
+	}
+
+	var result DetectFacesResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	if result.Faces == nil {
+		result.Faces = []model.Face{}
+	}
+
+	if err := saveMetadata(eventID, &result); err != nil {
+		return err
+	}
+
+	// A rerun after a crash finds some avatars already imported; importing
+	// them again would add a duplicate version
+	avatars := 0
+	for _, face := range result.Faces {
+		existing, err := repository.GetAvatar(eventID, face.Filename)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		avatar := legacyAvatar(eventID, face.Filename)
+		if avatar == nil {
+			continue
+		}
+		if err := repository.SetAvatar(avatar); err != nil {
+			return err
+		}
+		avatars++
+	}
+
+	log.Printf("[MetadataImport] Event %d: %d faces, %d avatars", eventID, len(result.Faces), avatars)
+	return nil
+}
+
+// legacyAvatar finds the avatar file of a face the way older versions did:
+// the most recently written of face_N.{jpg,jpeg,png}, with the QQ number read
+// from the face_N.json sidecar if there is one.
+func legacyAvatar(eventID int, faceFilename string) *model.Avatar {
+	baseName := faceBaseName(faceFilename)
+
+	var found string
+	var foundInfo *storage.ObjectInfo
+	for _, ext := range avatarExts {
+		info, err := storage.Stat(storage.AvatarKey(eventID, baseName+ext))
+		if err != nil {
+			continue
+		}
+		if foundInfo == nil || info.ModTime.After(foundInfo.ModTime) {
+			found, foundInfo = baseName+ext, info
+		}
+	}
+	if found == "" {
+		return nil
+	}
+
+	avatar := &model.Avatar{
+		EventID:  eventID,
+		Face:     faceFilename,
+		Filename: found,
+		Source:   model.AvatarSourceUpload,
+	}
+
+	var info struct {
+		QQNumber string `json:"qq_number"`
+	}
+	if data, err := storage.ReadFile(storage.AvatarKey(eventID, baseName+".json")); err == nil {
+		if json.Unmarshal(data, &info) == nil && info.QQNumber != "" {
+			avatar.Source = model.AvatarSourceQQ
+			avatar.QQNumber = info.QQNumber
+		}
+	}
+	return avatar
+}
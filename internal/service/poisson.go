@@ -0,0 +1,142 @@
+package service
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	poissonMaxIterations = 2000
+	poissonTolerance     = 0.05 // stop once no pixel moves by more than this
+	poissonOmega         = 1.9  // SOR over-relaxation factor
+)
+
+// seamlessPaste merges the avatar into the canvas in the gradient domain
+// ("seamless clone"): inside the mask the result keeps the avatar's gradients,
+// while at the mask border it takes the photo's colours, so the seam vanishes
+// without manual feathering. The Poisson equation is solved per channel with
+// successive over-relaxation.
+func seamlessPaste(canvas *image.RGBA, avatar *image.RGBA, mask *image.Alpha, p placement) {
+	area := p.bounds().Intersect(canvas.Bounds())
+	if area.Empty() {
+		return
+	}
+	w, h := area.Dx(), area.Dy()
+	n := w * h
+	toAvatar := p.inverse()
+	inner := canvas.Bounds().Inset(1) // region pixels need all four neighbours on the canvas
+
+	var (
+		guide  [3][]float64 // avatar colour (the guidance field source)
+		hasG   = make([]bool, n)
+		weight = make([]float64, n) // mask opacity
+		region = make([]bool, n)
+		pixels []int
+	)
+	for c := range guide {
+		guide[c] = make([]float64, n)
+	}
+
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			ax, ay, ok := toAvatar(x, y)
+			if !ok {
+				continue
+			}
+			r, g, b, a := sampleBilinear(avatar, ax-0.5, ay-0.5)
+			if a < 0.5 {
+				continue
+			}
+
+			i := (y-area.Min.Y)*w + (x - area.Min.X)
+			guide[0][i], guide[1][i], guide[2][i] = r/a, g/a, b/a
+			hasG[i] = true
+
+			m := float64(mask.Pix[int(ay)*mask.Stride+int(ax)]) / 255
+			if m > 0 && (image.Point{X: x, Y: y}).In(inner) {
+				weight[i] = m
+				region[i] = true
+				pixels = append(pixels, i)
+			}
+		}
+	}
+	if len(pixels) == 0 {
+		return
+	}
+
+	// photo returns the canvas value of channel c at area-relative index i,
+	// which may lie one pixel outside the area
+	photo := func(c, ix, iy int) float64 {
+		return float64(canvas.Pix[canvas.PixOffset(area.Min.X+ix, area.Min.Y+iy)+c])
+	}
+
+	offsets := [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}}
+	inArea := func(ix, iy int) bool { return ix >= 0 && iy >= 0 && ix < w && iy < h }
+
+	for c := 0; c < 3; c++ {
+		g := guide[c]
+
+		// Divergence of the guidance field, and a starting guess of the avatar
+		// shifted by the mean colour difference along the border
+		div := make([]float64, n)
+		var shift float64
+		var borderCount int
+		for _, i := range pixels {
+			ix, iy := i%w, i/w
+			for _, o := range offsets {
+				jx, jy := ix+o[0], iy+o[1]
+				if !inArea(jx, jy) {
+					shift += photo(c, jx, jy) - g[i]
+					borderCount++
+					continue
+				}
+				j := jy*w + jx
+				if hasG[j] {
+					div[i] += g[i] - g[j]
+				}
+				if !region[j] {
+					shift += photo(c, jx, jy) - g[i]
+					borderCount++
+				}
+			}
+		}
+		if borderCount > 0 {
+			shift /= float64(borderCount)
+		}
+
+		f := make([]float64, n)
+		for _, i := range pixels {
+			f[i] = g[i] + shift
+		}
+
+		for iter := 0; iter < poissonMaxIterations; iter++ {
+			maxDelta := 0.0
+			for _, i := range pixels {
+				ix, iy := i%w, i/w
+				sum := div[i]
+				for _, o := range offsets {
+					jx, jy := ix+o[0], iy+o[1]
+					if inArea(jx, jy) && region[jy*w+jx] {
+						sum += f[jy*w+jx]
+					} else {
+						sum += photo(c, jx, jy)
+					}
+				}
+				next := (1-poissonOmega)*f[i] + poissonOmega*sum/4
+				maxDelta = math.Max(maxDelta, math.Abs(next-f[i]))
+				f[i] = next
+			}
+			if maxDelta < poissonTolerance {
+				break
+			}
+		}
+
+		// Write back only after the channel converged, since photo() reads the canvas
+		for _, i := range pixels {
+			ix, iy := i%w, i/w
+			off := canvas.PixOffset(area.Min.X+ix, area.Min.Y+iy) + c
+			orig := float64(canvas.Pix[off])
+			canvas.Pix[off] = clampUint8(f[i]*weight[i] + orig*(1-weight[i]))
+		}
+	}
+}
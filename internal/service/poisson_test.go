@@ -0,0 +1,145 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// poissonScene is a 32x32 photo with a gentle gradient in every direction and
+// a 16x16 avatar pasted over its centre: a flat bright face with a dark square
+// inside, so the avatar has sharp interior edges but nothing that matches the
+// photo at the seam
+func poissonScene() (canvas, avatar *image.RGBA, mask *image.Alpha, p placement) {
+	canvas = image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			canvas.SetRGBA(x, y, color.RGBA{uint8(100 + 2*x), uint8(110 + 2*y), uint8(100 + x + y), 255})
+		}
+	}
+
+	avatar = image.NewRGBA(image.Rect(0, 0, 16, 16))
+	mask = image.NewAlpha(avatar.Bounds())
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			v := uint8(160)
+			if x >= 5 && x < 11 && y >= 5 && y < 11 {
+				v = 70
+			}
+			avatar.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+			mask.SetAlpha(x, y, color.Alpha{255})
+		}
+	}
+
+	return canvas, avatar, mask, placement{cx: 16, cy: 16, w: 16, h: 16}
+}
+
+func channel(img *image.RGBA, x, y, c int) float64 {
+	return float64(img.Pix[img.PixOffset(x, y)+c])
+}
+
+func TestSeamlessPasteMatchesPhotoAtBoundary(t *testing.T) {
+	canvas, avatar, mask, p := poissonScene()
+	photo := image.NewRGBA(canvas.Bounds())
+	copy(photo.Pix, canvas.Pix)
+
+	seamlessPaste(canvas, avatar, mask, p)
+
+	area := p.bounds()
+	if area != image.Rect(8, 8, 24, 24) {
+		t.Fatalf("placement covers %v", area)
+	}
+
+	// Across the seam the result steps by about the photo's own gradient
+	// (at most 3 per pixel here); a plain paste would jump by up to 44
+	var worst float64
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			for _, o := range [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				nx, ny := x+o[0], y+o[1]
+				if (image.Point{X: nx, Y: ny}).In(area) {
+					continue
+				}
+				for c := 0; c < 3; c++ {
+					worst = math.Max(worst, math.Abs(channel(canvas, x, y, c)-channel(photo, nx, ny, c)))
+				}
+			}
+		}
+	}
+	if worst > 6 {
+		t.Errorf("result differs from the photo across the seam by up to %.0f, want <= 6", worst)
+	}
+
+	// Outside the avatar the photo is untouched
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if (image.Point{X: x, Y: y}).In(area) {
+				continue
+			}
+			if canvas.RGBAAt(x, y) != photo.RGBAAt(x, y) {
+				t.Fatalf("pixel (%d,%d) outside the avatar changed", x, y)
+			}
+		}
+	}
+}
+
+func TestSeamlessPastePreservesInteriorGradients(t *testing.T) {
+	canvas, avatar, mask, p := poissonScene()
+	seamlessPaste(canvas, avatar, mask, p)
+
+	// Away from the seam every step between neighbours is the avatar's step,
+	// give or take the smooth correction that absorbs the photo's gradient.
+	// The dark square's 90-level edges must survive.
+	area := p.bounds()
+	var worst float64
+	for y := area.Min.Y + 2; y < area.Max.Y-2; y++ {
+		for x := area.Min.X + 2; x < area.Max.X-2; x++ {
+			ax, ay := x-area.Min.X, y-area.Min.Y
+			for c := 0; c < 3; c++ {
+				got := channel(canvas, x+1, y, c) - channel(canvas, x, y, c)
+				want := channel(avatar, ax+1, ay, c) - channel(avatar, ax, ay, c)
+				worst = math.Max(worst, math.Abs(got-want))
+
+				got = channel(canvas, x, y+1, c) - channel(canvas, x, y, c)
+				want = channel(avatar, ax, ay+1, c) - channel(avatar, ax, ay, c)
+				worst = math.Max(worst, math.Abs(got-want))
+			}
+		}
+	}
+	if worst > 4 {
+		t.Errorf("interior gradients differ from the avatar's by up to %.1f, want <= 4", worst)
+	}
+
+	// The square stays 90 levels darker than the face around it
+	for c := 0; c < 3; c++ {
+		edge := channel(canvas, 12, 16, c) - channel(canvas, 13, 16, c)
+		if math.Abs(edge-90) > 4 {
+			t.Errorf("channel %d: step into the square is %.0f, want about 90", c, edge)
+		}
+	}
+}
+
+func TestSeamlessPasteUniformPhotoShiftsAvatar(t *testing.T) {
+	// With a flat photo and an avatar whose border is flat too, the exact
+	// solution is the avatar shifted to the photo's colour
+	canvas, avatar, mask, p := poissonScene()
+	for i := 0; i < len(canvas.Pix); i += 4 {
+		canvas.Pix[i], canvas.Pix[i+1], canvas.Pix[i+2] = 120, 140, 100
+	}
+
+	seamlessPaste(canvas, avatar, mask, p)
+
+	area := p.bounds()
+	photo := [3]float64{120, 140, 100}
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			for c := 0; c < 3; c++ {
+				want := channel(avatar, x-area.Min.X, y-area.Min.Y, c) - 160 + photo[c]
+				if got := channel(canvas, x, y, c); math.Abs(got-want) > 1 {
+					t.Fatalf("pixel (%d,%d) channel %d = %.0f, want %.0f", x, y, c, got, want)
+				}
+			}
+		}
+	}
+}
@@ -1,14 +1,14 @@
 package service
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"time"
 
-	"avatar-face-swap-go/internal/storage"
+	"avatar-face-swap-go/internal/model"
 )
 
 type QQNameResponse struct {
@@ -50,7 +50,9 @@ func GetQQNickname(qqNumber string) (string, error) {
 	return fmt.Sprintf("QQ用户%s", qqNumber), nil
 }
 
-func DownloadQQAvatar(eventID int, face, qqNumber string) error {
+// DownloadQQAvatar fetches the avatar of a QQ account and stores it as a new
+// avatar version of the face, recorded as uploaded by uploadedBy from ip
+func DownloadQQAvatar(eventID int, face, qqNumber, uploadedBy, ip string) error {
 	url := fmt.Sprintf("https://q1.qlogo.cn/g?b=qq&nk=%s&s=640", qqNumber)
 
 	client := &http.Client{Timeout: 30 * time.Second}
@@ -65,31 +67,26 @@ func DownloadQQAvatar(eventID int, face, qqNumber string) error {
 		return fmt.Errorf("failed to download avatar: %d", resp.StatusCode)
 	}
 
-	if err := storage.EnsureEventDirs(eventID); err != nil {
-		return err
+	// Download before locking so a slow QQ server does not hold up the event.
+	// One byte over the limit is enough to refuse the avatar.
+	body := io.Reader(resp.Body)
+	if limit := loadQuotas().MaxAvatarBytes; limit > 0 {
+		body = io.LimitReader(resp.Body, limit+1)
 	}
-
-	baseName := face[:len(face)-len(".jpg")]
-	avatarPath := storage.GetAvatarPath(eventID, baseName+".jpg")
-
-	file, err := os.Create(avatarPath)
+	data, err := io.ReadAll(body)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
+	if err := CheckAvatarSize(int64(len(data))); err != nil {
 		return err
 	}
 
-	// QQ info JSON
-	jsonPath := storage.GetAvatarPath(eventID, baseName+".json")
-	info := map[string]string{
-		"qq_number": qqNumber,
-		"filename":  baseName + ".jpg",
-	}
-	jsonData, _ := json.Marshal(info)
-
-	return os.WriteFile(jsonPath, jsonData, 0644)
+	return SaveAvatarVersion(&model.Avatar{
+		EventID:    eventID,
+		Face:       face,
+		Source:     model.AvatarSourceQQ,
+		QQNumber:   qqNumber,
+		UploadedBy: uploadedBy,
+		UploaderIP: ip,
+	}, ".jpg", int64(len(data)), bytes.NewReader(data))
 }
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"avatar-face-swap-go/internal/model"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// reprocessMatchIoU is the minimum box overlap for a new detection to be
+// treated as the same person as an existing face
+const reprocessMatchIoU = 0.3
+
+// FaceMatch pairs an existing face with the new detection that replaced it
+type FaceMatch struct {
+	Previous string   `json:"previous"`
+	Current  string   `json:"current"`
+	IoU      float64  `json:"iou"`
+	Moved    []string `json:"moved,omitempty"` // avatar and QQ files now under Current
+}
+
+// ReprocessReport describes how a re-run changed the faces of an event
+type ReprocessReport struct {
+	Matched    []FaceMatch `json:"matched"`
+	Added      []string    `json:"added"`
+	Removed    []string    `json:"removed"`
+	KeptManual []string    `json:"kept_manual"`
+	// Avatars of removed faces are renamed out of the way rather than deleted
+	SetAside []string `json:"set_aside,omitempty"`
+}
+
+// ReprocessEventImage re-runs detection on the event picture and merges the
+// result into the existing faces: manual faces are kept, new detections are
+// matched to previous ones by box overlap, and avatars and QQ bindings follow
+// their face to its new filename.
+func ReprocessEventImage(detector FaceDetector, eventID int, settings model.DetectionSettings) (*DetectFacesResult, *ReprocessReport, error) {
+	log.Printf("[Reprocess] Starting for event %d", eventID)
+
+	imageKey := storage.OriginalKey(eventID)
+	detected, err := DetectFaces(detector, imageKey, settings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Faces edited while detection ran must not be lost, so the previous
+	// faces are read only once the event is locked
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+	if err := checkEventLive(eventID); err != nil {
+		return nil, nil, err
+	}
+
+	previous, err := LoadMetadata(eventID)
+	if errors.Is(err, ErrMetadataNotFound) {
+		previous = &DetectFacesResult{}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	report := &ReprocessReport{
+		Matched:    []FaceMatch{},
+		Added:      []string{},
+		Removed:    []string{},
+		KeptManual: []string{},
+	}
+
+	var manual, auto []model.Face
+	for _, face := range previous.Faces {
+		if face.Manual {
+			manual = append(manual, face)
+			report.KeptManual = append(report.KeptManual, face.Filename)
+		} else {
+			auto = append(auto, face)
+		}
+	}
+
+	// A detection on top of a manual face is dropped: the admin's box wins
+	var fresh []model.Face
+	for _, face := range detected.Faces {
+		covered := false
+		for _, m := range manual {
+			if faceIoU(face.Coordinates, m.Coordinates) >= reprocessMatchIoU {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			fresh = append(fresh, face)
+		}
+	}
+
+	// Number the detections again, skipping names a manual face already uses
+	taken := make(map[string]bool, len(manual))
+	for _, m := range manual {
+		taken[m.Filename] = true
+	}
+	n := 0
+	for i := range fresh {
+		for {
+			n++
+			if name := fmt.Sprintf("face_%d.jpg", n); !taken[name] {
+				fresh[i].Filename = name
+				break
+			}
+		}
+	}
+
+	// Greedy one-to-one matching, best overlap first
+	type pair struct {
+		old, new int
+		iou      float64
+	}
+	var pairs []pair
+	for i, old := range auto {
+		for j, face := range fresh {
+			if iou := faceIoU(old.Coordinates, face.Coordinates); iou >= reprocessMatchIoU {
+				pairs = append(pairs, pair{i, j, iou})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(a, b int) bool { return pairs[a].iou > pairs[b].iou })
+
+	usedOld := make([]bool, len(auto))
+	usedNew := make([]bool, len(fresh))
+	moves := map[string]string{} // previous detected face -> new base name
+	for _, p := range pairs {
+		if usedOld[p.old] || usedNew[p.new] {
+			continue
+		}
+		usedOld[p.old], usedNew[p.new] = true, true
+		moves[auto[p.old].Filename] = faceBaseName(fresh[p.new].Filename)
+		report.Matched = append(report.Matched, FaceMatch{
+			Previous: auto[p.old].Filename,
+			Current:  fresh[p.new].Filename,
+			IoU:      p.iou,
+		})
+	}
+
+	suffix := fmt.Sprintf(".removed-%d", time.Now().UnixMilli())
+	for i, old := range auto {
+		if !usedOld[i] {
+			report.Removed = append(report.Removed, old.Filename)
+			moves[old.Filename] = faceBaseName(old.Filename) + suffix
+		}
+	}
+	for j, face := range fresh {
+		if !usedNew[j] {
+			report.Added = append(report.Added, face.Filename)
+		}
+	}
+
+	// Replace the crops of detected faces; manual crops stay as they are
+	img, err := decodeImage(imageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, old := range auto {
+		if err := storage.Delete(storage.FaceKey(eventID, old.Filename)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := saveFaceCrops(eventID, img, fresh); err != nil {
+		return nil, nil, err
+	}
+
+	moved, err := moveAvatars(eventID, moves, report.Removed)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range report.Matched {
+		report.Matched[i].Moved = moved[report.Matched[i].Previous]
+	}
+	for _, name := range report.Removed {
+		report.SetAside = append(report.SetAside, moved[name]...)
+	}
+
+	// Claims follow their faces like avatars; claims on removed faces are dropped
+	claimMoves := map[string]string{}
+	for _, old := range auto {
+		if to := moves[old.Filename]; to != faceBaseName(old.Filename) {
+			claimMoves[old.Filename] = to + filepath.Ext(old.Filename)
+		}
+	}
+	for _, name := range report.Removed {
+		claimMoves[name] = ""
+	}
+	if err := repository.MoveFaceClaims(eventID, claimMoves); err != nil {
+		return nil, nil, err
+	}
+
+	result := &DetectFacesResult{
+		ImageInfo: detected.ImageInfo,
+		Faces:     append(fresh, manual...),
+	}
+	if err := saveMetadata(eventID, result); err != nil {
+		return nil, nil, err
+	}
+	InvalidateComposite(eventID)
+
+	log.Printf("[Reprocess] Event %d: %d matched, %d added, %d removed, %d manual kept",
+		eventID, len(report.Matched), len(report.Added), len(report.Removed), len(report.KeptManual))
+	return result, report, nil
+}
+
+// moveAvatars renames every avatar version of each previously detected face
+// to the face's new base name, points the avatar records at the renamed faces
+// and drops the records of removed faces, whose files are set aside. Avatars of
+// faces not in moves, such as manual faces sharing a base name, are left alone.
+// It returns the new filenames per previous face. Names can swap (face_1 <->
+// face_2), so every file is first moved to a temporary name and only then to
+// its target.
+func moveAvatars(eventID int, moves map[string]string, removed []string) (map[string][]string, error) {
+	avatars, err := repository.GetAllAvatarVersions(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	gone := make(map[string]bool, len(removed))
+	for _, name := range removed {
+		gone[name] = true
+	}
+
+	type rename struct{ face, tmp, to string }
+	var renames []rename
+	var avatarMoves []repository.AvatarMove
+
+	for _, avatar := range avatars {
+		from := faceBaseName(avatar.Face)
+		to, ok := moves[avatar.Face]
+		if !ok || to == from {
+			continue
+		}
+
+		// face_1.v2.png becomes face_3.v2.png; older names keep only the extension
+		filename := to + filepath.Ext(avatar.Filename)
+		if rest, ok := strings.CutPrefix(avatar.Filename, from+"."); ok {
+			filename = to + "." + rest
+		}
+
+		move := repository.AvatarMove{ID: avatar.ID}
+		if !gone[avatar.Face] {
+			move.To = to + filepath.Ext(avatar.Face)
+			move.Filename = filename
+		}
+		avatarMoves = append(avatarMoves, move)
+
+		src := storage.AvatarKey(eventID, avatar.Filename)
+		if !storage.Exists(src) {
+			continue
+		}
+		renames = append(renames, rename{
+			face: avatar.Face,
+			tmp:  storage.AvatarKey(eventID, ".reprocess-"+avatar.Filename),
+			to:   filename,
+		})
+		if err := storage.Move(src, renames[len(renames)-1].tmp); err != nil {
+			return nil, err
+		}
+	}
+
+	moved := map[string][]string{}
+	for _, r := range renames {
+		if err := storage.Move(r.tmp, storage.AvatarKey(eventID, r.to)); err != nil {
+			return nil, err
+		}
+		moved[r.face] = append(moved[r.face], r.to)
+	}
+
+	if len(avatarMoves) > 0 {
+		if err := repository.MoveAvatars(eventID, avatarMoves); err != nil {
+			return nil, err
+		}
+	}
+	return moved, nil
+}
+
+func faceBaseName(filename string) string {
+	return filename[:len(filename)-len(filepath.Ext(filename))]
+}
+
+func faceIoU(a, b model.FaceCoordinate) float64 {
+	ra := image.Rect(a.X1, a.Y1, a.X2, a.Y2)
+	rb := image.Rect(b.X1, b.Y1, b.X2, b.Y2)
+	inter := ra.Intersect(rb)
+	if inter.Empty() {
+		return 0
+	}
+	interArea := inter.Dx() * inter.Dy()
+	union := ra.Dx()*ra.Dy() + rb.Dx()*rb.Dy() - interArea
+	return float64(interArea) / float64(union)
+}
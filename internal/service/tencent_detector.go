@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"sort"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/model"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
+	iai "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/iai/v20200303"
+)
+
+// Tencent API limits: JPG max 4000px on the long edge, 5MB of image data, and
+// quality scores only for the 30 largest faces of a request
+const (
+	tencentMaxEdge         = 4000
+	tencentMaxBytes        = 5 * 1024 * 1024
+	tencentMaxQualityFaces = 30
+)
+
+// TencentDetector detects faces with the Tencent Cloud IAI DetectFace API
+type TencentDetector struct {
+	client          *iai.Client
+	detectLandmarks bool
+	retry           tencentRetryPolicy
+}
+
+func NewTencentDetector(cfg *config.Config) (*TencentDetector, error) {
+	if cfg.TencentSecretID == "" || cfg.TencentSecretKey == "" {
+		return nil, fmt.Errorf("%w: credentials not configured", ErrTencentPermanent)
+	}
+
+	credential := common.NewCredential(cfg.TencentSecretID, cfg.TencentSecretKey)
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = cfg.TencentEndpoint
+
+	client, err := iai.NewClient(credential, cfg.TencentRegion, cpf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to create client: %w", ErrTencentPermanent, err)
+	}
+
+	return &TencentDetector{
+		client:          client,
+		detectLandmarks: cfg.DetectLandmarks,
+		retry:           newTencentRetryPolicy(cfg),
+	}, nil
+}
+
+func (d *TencentDetector) Name() string {
+	return DetectorTencent
+}
+
+func (d *TencentDetector) Detect(req DetectRequest) ([]DetectedFace, error) {
+	img := req.Image
+	imageData := req.Data
+
+	bounds := img.Bounds()
+	origWidth, origHeight := bounds.Dx(), bounds.Dy()
+	longEdge := max(origWidth, origHeight)
+
+	var scale float64 = 1.0
+	if longEdge > tencentMaxEdge || imageData == nil {
+		if longEdge > tencentMaxEdge {
+			scale = float64(tencentMaxEdge) / float64(longEdge)
+			newWidth := int(float64(origWidth) * scale)
+			newHeight := int(float64(origHeight) * scale)
+			log.Printf("[FaceDetection] Resizing to %dx%d (scale: %.2f)", newWidth, newHeight, scale)
+
+			img = resizeImage(img, newWidth, newHeight)
+		}
+
+		// Re-encode to JPEG
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, fmt.Errorf("failed to encode resized image: %w", err)
+		}
+		imageData = buf.Bytes()
+		log.Printf("[FaceDetection] Encoded image size: %d bytes", len(imageData))
+	}
+
+	// Check if image is too large (5MB limit for base64)
+	if len(imageData) > tencentMaxBytes {
+		return nil, fmt.Errorf("image too large: %d bytes (max 5MB)", len(imageData))
+	}
+
+	imageBase64 := base64.StdEncoding.EncodeToString(imageData)
+
+	// Build request
+	request := iai.NewDetectFaceRequest()
+	maxFaceNum := uint64(defaultMaxFaceNum)
+	if req.MaxFaces > 0 {
+		maxFaceNum = uint64(req.MaxFaces)
+	}
+	minFaceSize := uint64(defaultMinFaceSize)
+	if req.MinFaceSize > 0 {
+		minFaceSize = uint64(req.MinFaceSize)
+	}
+	faceModelVersion := defaultModelVersion
+	if req.ModelVersion != "" {
+		faceModelVersion = req.ModelVersion
+	}
+	needFaceAttributes := uint64(1) // pose (roll/yaw/pitch)
+	needQualityDetection := uint64(1)
+
+	request.Image = &imageBase64
+	request.MaxFaceNum = &maxFaceNum
+	request.MinFaceSize = &minFaceSize
+	request.FaceModelVersion = &faceModelVersion
+	request.NeedFaceAttributes = &needFaceAttributes
+	request.NeedQualityDetection = &needQualityDetection
+
+	// Call API
+	log.Printf("[FaceDetection] Calling Tencent API...")
+	var response *iai.DetectFaceResponse
+	err := callTencent(d.retry, "DetectFace", func() (err error) {
+		response, err = d.client.DetectFace(request)
+		return err
+	})
+	if err != nil {
+		log.Printf("[FaceDetection] API call failed: %v", err)
+		return nil, fmt.Errorf("Tencent API error: %w", err)
+	}
+
+	log.Printf("[FaceDetection] API call successful, found %d faces", len(response.Response.FaceInfos))
+
+	qualityRated := largestFaces(response.Response.FaceInfos, tencentMaxQualityFaces)
+
+	faces := make([]DetectedFace, 0, len(response.Response.FaceInfos))
+	for i, face := range response.Response.FaceInfos {
+		detected := DetectedFace{
+			X:      int(*face.X),
+			Y:      int(*face.Y),
+			Width:  int(*face.Width),
+			Height: int(*face.Height),
+		}
+
+		// Scale coordinates back to original image size
+		if scale < 1.0 {
+			detected.X = int(float64(detected.X) / scale)
+			detected.Y = int(float64(detected.Y) / scale)
+			detected.Width = int(float64(detected.Width) / scale)
+			detected.Height = int(float64(detected.Height) / scale)
+		}
+		detected.X += bounds.Min.X
+		detected.Y += bounds.Min.Y
+
+		if attrs := face.FaceAttributesInfo; attrs != nil && attrs.Roll != nil && attrs.Yaw != nil && attrs.Pitch != nil {
+			detected.Pose = &model.FacePose{
+				Roll:  int(*attrs.Roll),
+				Yaw:   int(*attrs.Yaw),
+				Pitch: int(*attrs.Pitch),
+			}
+		}
+
+		if qualityRated[i] {
+			detected.Quality = parseFaceQuality(face.FaceQualityInfo)
+		}
+
+		if d.detectLandmarks {
+			box := model.FaceCoordinate{
+				X1: max(bounds.Min.X, detected.X),
+				Y1: max(bounds.Min.Y, detected.Y),
+				X2: min(bounds.Max.X, detected.X+detected.Width),
+				Y2: min(bounds.Max.Y, detected.Y+detected.Height),
+			}
+			landmarks, err := d.analyzeLandmarks(req.Image, box, faceModelVersion)
+			if err != nil {
+				log.Printf("[FaceDetection] Face %d: landmark analysis failed: %v", i+1, err)
+			} else {
+				detected.Landmarks = landmarks
+			}
+		}
+
+		faces = append(faces, detected)
+	}
+
+	return faces, nil
+}
+
+// largestFaces returns the indices of the n largest faces by box area, the only
+// ones whose quality scores are meaningful
+func largestFaces(infos []*iai.FaceInfo, n int) map[int]bool {
+	order := make([]int, len(infos))
+	for i := range order {
+		order[i] = i
+	}
+	area := func(i int) int64 { return *infos[i].Width * *infos[i].Height }
+	sort.SliceStable(order, func(a, b int) bool { return area(order[a]) > area(order[b]) })
+
+	rated := make(map[int]bool, min(n, len(order)))
+	for _, i := range order[:min(n, len(order))] {
+		rated[i] = true
+	}
+	return rated
+}
+
+func parseFaceQuality(info *iai.FaceQualityInfo) *model.FaceQuality {
+	if info == nil || info.Score == nil {
+		return nil
+	}
+	value := func(v *int64) int {
+		if v == nil {
+			return 0
+		}
+		return int(*v)
+	}
+
+	quality := &model.FaceQuality{
+		Score:      value(info.Score),
+		Sharpness:  value(info.Sharpness),
+		Brightness: value(info.Brightness),
+	}
+	if c := info.Completeness; c != nil {
+		quality.Completeness = &model.FaceCompleteness{
+			Eyebrow: value(c.Eyebrow),
+			Eye:     value(c.Eye),
+			Nose:    value(c.Nose),
+			Cheek:   value(c.Cheek),
+			Mouth:   value(c.Mouth),
+			Chin:    value(c.Chin),
+		}
+	}
+	return quality
+}
+
+// analyzeLandmarks runs AnalyzeFace on a single face crop at full resolution,
+// since AnalyzeFace only returns landmarks for up to 10 faces per image.
+func (d *TencentDetector) analyzeLandmarks(img image.Image, box model.FaceCoordinate, faceModelVersion string) (*model.FaceLandmarks, error) {
+	crop := cropImageRect(img, box.X1, box.Y1, box.X2, box.Y2)
+	cropW, cropH := box.X2-box.X1, box.Y2-box.Y1
+	if cropW <= 0 || cropH <= 0 {
+		return nil, fmt.Errorf("empty face box")
+	}
+
+	// AnalyzeFace needs a short edge of at least 64px; large crops are capped at 2000px
+	scale := 1.0
+	if short := min(cropW, cropH); short < 64 {
+		scale = 64.0 / float64(short)
+	} else if long := max(cropW, cropH); long > 2000 {
+		scale = 2000.0 / float64(long)
+	}
+	if scale != 1.0 {
+		crop = resizeImage(crop, int(float64(cropW)*scale+0.5), int(float64(cropH)*scale+0.5))
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, crop, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	imageBase64 := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	request := iai.NewAnalyzeFaceRequest()
+	mode := uint64(1) // largest face only
+	request.Image = &imageBase64
+	request.Mode = &mode
+	request.FaceModelVersion = &faceModelVersion
+
+	var response *iai.AnalyzeFaceResponse
+	err := callTencent(d.retry, "AnalyzeFace", func() (err error) {
+		response, err = d.client.AnalyzeFace(request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Response.FaceShapeSet) == 0 {
+		return nil, fmt.Errorf("no face shape returned")
+	}
+	shape := response.Response.FaceShapeSet[0]
+
+	// Map a crop-space point back to the original image
+	toOriginal := func(points []*iai.Point) (model.FacePoint, bool) {
+		if len(points) == 0 {
+			return model.FacePoint{}, false
+		}
+		var sumX, sumY float64
+		for _, p := range points {
+			sumX += float64(*p.X)
+			sumY += float64(*p.Y)
+		}
+		n := float64(len(points))
+		return model.FacePoint{
+			X: box.X1 + int(sumX/n/scale+0.5),
+			Y: box.Y1 + int(sumY/n/scale+0.5),
+		}, true
+	}
+
+	leftEye, ok1 := toOriginal(shape.LeftPupil)
+	if !ok1 {
+		leftEye, ok1 = toOriginal(shape.LeftEye)
+	}
+	rightEye, ok2 := toOriginal(shape.RightPupil)
+	if !ok2 {
+		rightEye, ok2 = toOriginal(shape.RightEye)
+	}
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("eyes not located")
+	}
+	nose, _ := toOriginal(shape.Nose)
+	mouth, _ := toOriginal(shape.Mouth)
+
+	return &model.FaceLandmarks{
+		LeftEye:  leftEye,
+		RightEye: rightEye,
+		Nose:     nose,
+		Mouth:    mouth,
+	}, nil
+}
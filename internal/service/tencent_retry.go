@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+
+	tcerr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+	iai "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/iai/v20200303"
+)
+
+// Tencent error codes worth another attempt: throttling, timeouts and
+// server-side failures. Anything else (bad image, no face, auth) is permanent.
+var retryableTencentCodes = map[string]bool{
+	iai.REQUESTLIMITEXCEEDED:                 true,
+	iai.FAILEDOPERATION_REQUESTLIMITEXCEEDED: true,
+	iai.FAILEDOPERATION_REQUESTTIMEOUT:       true,
+	iai.FAILEDOPERATION_SERVERERROR:          true,
+	iai.INTERNALERROR:                        true,
+	"ClientError.NetworkError":               true,
+	"ClientError.HttpStatusCodeError":        true,
+}
+
+// ErrTencentPermanent wraps Tencent errors that no retry can fix, such as bad
+// credentials or an image the API refuses
+var ErrTencentPermanent = errors.New("Tencent Cloud request cannot succeed")
+
+// tencentError wraps err in ErrTencentPermanent unless it is transient
+func tencentError(err error) error {
+	if isRetryableTencentError(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrTencentPermanent, err)
+}
+
+// isRetryableTencentError reports whether err is transient
+func isRetryableTencentError(err error) bool {
+	var sdkErr *tcerr.TencentCloudSDKError
+	if errors.As(err, &sdkErr) {
+		if retryableTencentCodes[sdkErr.Code] {
+			return true
+		}
+		// Sub-codes such as RequestLimitExceeded.UinLimitExceeded
+		return strings.HasPrefix(sdkErr.Code, iai.REQUESTLIMITEXCEEDED+".") ||
+			strings.HasPrefix(sdkErr.Code, iai.INTERNALERROR+".")
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// tencentRetryPolicy controls how failed Tencent calls are retried
+type tencentRetryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func newTencentRetryPolicy(cfg *config.Config) tencentRetryPolicy {
+	return tencentRetryPolicy{
+		maxRetries: max(cfg.TencentMaxRetries, 0),
+		baseDelay:  time.Duration(cfg.TencentRetryBaseMs) * time.Millisecond,
+		maxDelay:   time.Duration(cfg.TencentRetryMaxMs) * time.Millisecond,
+	}
+}
+
+// delay returns the wait before retry n (0-based): exponential backoff capped
+// at maxDelay, with "equal jitter" so concurrent callers spread out
+func (p tencentRetryPolicy) delay(n int) time.Duration {
+	d := p.baseDelay << min(n, 20)
+	if d > p.maxDelay || d <= 0 {
+		d = p.maxDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half+1)
+}
+
+// callTencent runs one Tencent API call through the shared rate limiter,
+// retrying transient errors according to the policy. Other errors come back
+// wrapped in ErrTencentPermanent.
+func callTencent(policy tencentRetryPolicy, action string, call func() error) error {
+	limiter := tencentRateLimiter()
+	for attempt := 0; ; attempt++ {
+		limiter.Wait(context.Background())
+
+		err := call()
+		if err == nil {
+			return nil
+		}
+		if attempt >= policy.maxRetries || !isRetryableTencentError(err) {
+			return tencentError(err)
+		}
+
+		wait := policy.delay(attempt)
+		log.Printf("[Tencent] %s failed (attempt %d/%d), retrying in %v: %v", action, attempt+1, policy.maxRetries+1, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// tokenBucket is a minimal token-bucket rate limiter: it holds up to burst
+// tokens and refills at rate tokens per second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available or ctx is done. A bucket with a
+// non-positive rate never blocks.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	if b.rate <= 0 {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+var (
+	tencentLimiter     *tokenBucket
+	tencentLimiterOnce sync.Once
+)
+
+// tencentRateLimiter returns the process-wide limiter for Tencent API calls,
+// shared by every detection worker and request
+func tencentRateLimiter() *tokenBucket {
+	tencentLimiterOnce.Do(func() {
+		cfg := config.Current()
+		tencentLimiter = newTokenBucket(cfg.TencentQPS, max(int(cfg.TencentQPS), 1))
+		log.Printf("[Tencent] Rate limit: %.1f requests/s", cfg.TencentQPS)
+	})
+	return tencentLimiter
+}
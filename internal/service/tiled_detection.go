@@ -0,0 +1,147 @@
+package service
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"sort"
+)
+
+// tiledMergeOverlap is the share of the smaller box that must be covered by a
+// larger one for the two to count as the same face. Using the smaller box
+// (rather than IoU) also catches faces cut in half by a tile edge.
+const tiledMergeOverlap = 0.5
+
+// minTileSize keeps a misconfigured tile size from producing thousands of calls
+const minTileSize = 256
+
+// TiledDetector runs another detector over overlapping tiles of the image at
+// native resolution, so small faces in very large photos survive instead of
+// being lost to downscaling, and per-call face limits apply per tile.
+type TiledDetector struct {
+	inner    FaceDetector
+	tileSize int
+	overlap  int
+}
+
+// NewTiledDetector wraps inner. The overlap should exceed the largest face
+// expected, so every face lies whole inside at least one tile.
+func NewTiledDetector(inner FaceDetector, tileSize, overlap int) *TiledDetector {
+	tileSize = max(tileSize, minTileSize)
+	overlap = min(max(overlap, 0), tileSize/2)
+	return &TiledDetector{inner: inner, tileSize: tileSize, overlap: overlap}
+}
+
+func (d *TiledDetector) Name() string {
+	return d.inner.Name() + " (tiled)"
+}
+
+func (d *TiledDetector) Detect(req DetectRequest) ([]DetectedFace, error) {
+	bounds := req.Image.Bounds()
+	if max(bounds.Dx(), bounds.Dy()) <= d.tileSize {
+		return d.inner.Detect(req)
+	}
+
+	tiles := tileRects(bounds, d.tileSize, d.overlap)
+	log.Printf("[TiledDetection] Splitting %dx%d into %d tiles of %dpx (overlap %dpx)",
+		bounds.Dx(), bounds.Dy(), len(tiles), d.tileSize, d.overlap)
+
+	var all []DetectedFace
+	for i, tile := range tiles {
+		// Tiles keep the original coordinates, so boxes need no translation
+		faces, err := d.inner.Detect(DetectRequest{
+			Image:        cropImageRect(req.Image, tile.Min.X, tile.Min.Y, tile.Max.X, tile.Max.Y),
+			MaxFaces:     req.MaxFaces,
+			MinFaceSize:  req.MinFaceSize,
+			ModelVersion: req.ModelVersion,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tile %d/%d %v: %w", i+1, len(tiles), tile, err)
+		}
+		log.Printf("[TiledDetection] Tile %d/%d %v: %d faces", i+1, len(tiles), tile, len(faces))
+		all = append(all, faces...)
+	}
+
+	faces := suppressDuplicateFaces(all, tiledMergeOverlap)
+
+	sort.Slice(faces, func(i, j int) bool {
+		if faces[i].Y != faces[j].Y {
+			return faces[i].Y < faces[j].Y
+		}
+		return faces[i].X < faces[j].X
+	})
+
+	log.Printf("[TiledDetection] %d faces after merging %d tile detections", len(faces), len(all))
+	return faces, nil
+}
+
+// tileRects covers bounds with size x size tiles overlapping by overlap pixels;
+// the last tile in each direction is aligned to the image edge.
+func tileRects(bounds image.Rectangle, size, overlap int) []image.Rectangle {
+	xs := tileStarts(bounds.Min.X, bounds.Max.X, size, overlap)
+	ys := tileStarts(bounds.Min.Y, bounds.Max.Y, size, overlap)
+
+	tiles := make([]image.Rectangle, 0, len(xs)*len(ys))
+	for _, y := range ys {
+		for _, x := range xs {
+			tiles = append(tiles, image.Rect(x, y, x+size, y+size).Intersect(bounds))
+		}
+	}
+	return tiles
+}
+
+func tileStarts(lo, hi, size, overlap int) []int {
+	if hi-lo <= size {
+		return []int{lo}
+	}
+	step := max(size-overlap, 1)
+	var starts []int
+	for start := lo; ; start += step {
+		if start+size >= hi {
+			starts = append(starts, hi-size)
+			break
+		}
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// suppressDuplicateFaces is a greedy non-maximum suppression: larger boxes are
+// kept first and any box mostly covered by a kept one is dropped.
+func suppressDuplicateFaces(faces []DetectedFace, threshold float64) []DetectedFace {
+	sorted := make([]DetectedFace, len(faces))
+	copy(sorted, faces)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Width*sorted[i].Height > sorted[j].Width*sorted[j].Height
+	})
+
+	var kept []DetectedFace
+	for _, face := range sorted {
+		duplicate := false
+		for _, k := range kept {
+			if overlapOfSmaller(face, k) > threshold {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, face)
+		}
+	}
+	return kept
+}
+
+// overlapOfSmaller returns the intersection area divided by the smaller box's area
+func overlapOfSmaller(a, b DetectedFace) float64 {
+	ra := image.Rect(a.X, a.Y, a.X+a.Width, a.Y+a.Height)
+	rb := image.Rect(b.X, b.Y, b.X+b.Width, b.Y+b.Height)
+	inter := ra.Intersect(rb)
+	if inter.Empty() {
+		return 0
+	}
+	smaller := min(ra.Dx()*ra.Dy(), rb.Dx()*rb.Dy())
+	if smaller == 0 {
+		return 0
+	}
+	return float64(inter.Dx()*inter.Dy()) / float64(smaller)
+}
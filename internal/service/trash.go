@@ -0,0 +1,135 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/repository"
+	"avatar-face-swap-go/internal/storage"
+)
+
+// trashPurgeInterval is how often expired events are purged from the trash
+const trashPurgeInterval = time.Hour
+
+// ErrEventDeleted is returned when an event is moved to the trash while it is
+// being processed
+var ErrEventDeleted = errors.New("event has been deleted")
+
+// TrashEvent hides the event and moves its files to the trash area, where they
+// stay until the event is restored or purged
+func TrashEvent(eventID int) error {
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	// The event is hidden first, so a failed move leaves it restorable
+	if err := repository.TrashEvent(eventID); err != nil {
+		return err
+	}
+	n, err := storage.MovePrefix(storage.EventPrefix(eventID), storage.TrashPrefix(eventID))
+	if err != nil {
+		return err
+	}
+	log.Printf("[Trash] Event %d moved to trash (%d files)", eventID, n)
+	return nil
+}
+
+// RestoreEvent moves the files of a trashed event back and makes it visible again
+func RestoreEvent(eventID int) error {
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	n, err := storage.MovePrefix(storage.TrashPrefix(eventID), storage.EventPrefix(eventID))
+	if err != nil {
+		return err
+	}
+	if err := repository.RestoreEvent(eventID); err != nil {
+		return err
+	}
+	log.Printf("[Trash] Event %d restored (%d files)", eventID, n)
+	return nil
+}
+
+// PurgeEvent permanently removes a trashed event, its files and its records
+func PurgeEvent(eventID int) error {
+	unlock := storage.LockEvent(eventID)
+	defer unlock()
+
+	n, err := storage.DeletePrefix(storage.TrashPrefix(eventID))
+	if err != nil {
+		return err
+	}
+	// Files written by a request that raced the move to the trash
+	stray, err := storage.DeletePrefix(storage.EventPrefix(eventID))
+	if err != nil {
+		return err
+	}
+	if err := repository.DeleteEvent(eventID); err != nil {
+		return err
+	}
+	log.Printf("[Trash] Event %d purged (%d files)", eventID, n+stray)
+	return nil
+}
+
+// PurgeExpiredEvents purges the events that have been in the trash longer
+// than the retention period and returns how many were purged
+func PurgeExpiredEvents(retentionDays int) (int, error) {
+	if retentionDays <= 0 {
+		return 0, nil
+	}
+
+	ids, err := repository.GetExpiredTrashedEventIDs(time.Now().AddDate(0, 0, -retentionDays))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		if err := PurgeEvent(id); err != nil {
+			return purged, err
+		}
+		LogActivity("INFO", "活动管理", "自动清理回收站", "", "", "", map[string]any{
+			"event_id":       id,
+			"retention_days": retentionDays,
+		})
+		purged++
+	}
+	return purged, nil
+}
+
+// TrashPurgeTime returns when a trashed event will be purged, or the zero time
+// if it is kept until purged by hand
+func TrashPurgeTime(deletedAt string, retentionDays int) time.Time {
+	if retentionDays <= 0 {
+		return time.Time{}
+	}
+	// The driver reports DATETIME columns in RFC 3339
+	t, err := time.Parse(time.RFC3339, deletedAt)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02 15:04:05", deletedAt); err != nil {
+			return time.Time{}
+		}
+	}
+	return t.AddDate(0, 0, retentionDays)
+}
+
+// StartTrashPurger purges expired events now and then every trashPurgeInterval
+func StartTrashPurger(cfg *config.Config) {
+	if cfg.TrashRetentionDays <= 0 {
+		log.Printf("[Trash] Automatic purge disabled")
+		return
+	}
+
+	go func() {
+		for {
+			n, err := PurgeExpiredEvents(cfg.TrashRetentionDays)
+			if err != nil {
+				log.Printf("[Trash] Purge failed: %v", err)
+			} else if n > 0 {
+				log.Printf("[Trash] Purged %d expired events", n)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+	"avatar-face-swap-go/internal/storage"
+)
+
+const megabyte = 1 << 20
+
+var (
+	// ErrAvatarTooLarge is returned for avatars above config.MaxAvatarSizeMB
+	ErrAvatarTooLarge = errors.New("avatar too large")
+	// ErrQuotaExceeded is returned when an upload would exceed the event or
+	// global storage quota
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// UsageStat counts stored files and their total size
+type UsageStat struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (u *UsageStat) add(size int64) {
+	u.Files++
+	u.Bytes += size
+}
+
+// EventUsage is the storage used by one event, split by kind of file.
+// Other holds composites and sidecar files.
+type EventUsage struct {
+	EventID  int       `json:"event_id"`
+	Trashed  bool      `json:"trashed,omitempty"` // the files are in the trash
+	Original UsageStat `json:"original"`
+	Faces    UsageStat `json:"faces"`
+	Avatars  UsageStat `json:"avatars"`
+	Other    UsageStat `json:"other"`
+	Total    UsageStat `json:"total"`
+}
+
+func (u *EventUsage) add(rel string, size int64) {
+	switch {
+	case rel == "original.jpg":
+		u.Original.add(size)
+	case strings.HasPrefix(rel, "faces/"):
+		u.Faces.add(size)
+	case strings.HasPrefix(rel, "avatars/"):
+		u.Avatars.add(size)
+	default:
+		u.Other.add(size)
+	}
+	u.Total.add(size)
+}
+
+// UsageReport is the storage used by every event, largest first. Other counts
+// files outside any event directory, such as legacy leftovers.
+type UsageReport struct {
+	Events []EventUsage `json:"events"`
+	Other  UsageStat    `json:"other"`
+	Total  UsageStat    `json:"total"`
+	Quotas Quotas       `json:"quotas"`
+}
+
+// Quotas are the configured limits in bytes, 0 for no limit
+type Quotas struct {
+	MaxAvatarBytes int64 `json:"max_avatar_bytes"`
+	EventBytes     int64 `json:"event_bytes"`
+	StorageBytes   int64 `json:"storage_bytes"`
+}
+
+func loadQuotas() Quotas {
+	cfg := config.Current()
+	return Quotas{
+		MaxAvatarBytes: int64(max(cfg.MaxAvatarSizeMB, 0)) * megabyte,
+		EventBytes:     int64(max(cfg.EventQuotaMB, 0)) * megabyte,
+		StorageBytes:   int64(max(cfg.StorageQuotaMB, 0)) * megabyte,
+	}
+}
+
+// GetEventUsage returns the storage used by the live files of an event
+func GetEventUsage(eventID int) (*EventUsage, error) {
+	prefix := storage.EventPrefix(eventID)
+	objects, err := storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &EventUsage{EventID: eventID}
+	for _, obj := range objects {
+		usage.add(strings.TrimPrefix(obj.Key, prefix), obj.Size)
+	}
+	return usage, nil
+}
+
+// GetUsageReport walks the whole storage and adds up the usage of each event,
+// counting trashed events separately from live ones
+func GetUsageReport() (*UsageReport, error) {
+	objects, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{Events: []EventUsage{}, Quotas: loadQuotas()}
+	type eventKey struct {
+		id      int
+		trashed bool
+	}
+	events := map[eventKey]*EventUsage{}
+
+	for _, obj := range objects {
+		report.Total.add(obj.Size)
+
+		key, trashed := strings.CutPrefix(obj.Key, "trash/")
+		var id int
+		if _, err := fmt.Sscanf(key, "events/%d/", &id); err != nil || !strings.HasPrefix(key, storage.EventPrefix(id)) {
+			report.Other.add(obj.Size)
+			continue
+		}
+
+		usage := events[eventKey{id, trashed}]
+		if usage == nil {
+			usage = &EventUsage{EventID: id, Trashed: trashed}
+			events[eventKey{id, trashed}] = usage
+		}
+		usage.add(strings.TrimPrefix(key, storage.EventPrefix(id)), obj.Size)
+	}
+
+	for _, usage := range events {
+		report.Events = append(report.Events, *usage)
+	}
+	sort.Slice(report.Events, func(i, j int) bool {
+		a, b := report.Events[i], report.Events[j]
+		if a.Total.Bytes != b.Total.Bytes {
+			return a.Total.Bytes > b.Total.Bytes
+		}
+		return a.EventID < b.EventID
+	})
+	return report, nil
+}
+
+// CheckAvatarSize fails with ErrAvatarTooLarge if an avatar of size bytes is
+// above the configured maximum
+func CheckAvatarSize(size int64) error {
+	limit := loadQuotas().MaxAvatarBytes
+	if limit > 0 && size > limit {
+		return fmt.Errorf("%w: %s exceeds the limit of %s", ErrAvatarTooLarge, formatBytes(size), formatBytes(limit))
+	}
+	return nil
+}
+
+// CheckUploadQuota fails with ErrQuotaExceeded if storing size more bytes for
+// the event would go over the event or global quota. replaced lists keys the
+// upload overwrites or deletes, whose space is freed. Callers hold the event
+// lock, so uploads to one event are counted one after the other.
+func CheckUploadQuota(eventID int, size int64, replaced ...string) error {
+	quotas := loadQuotas()
+	if quotas.EventBytes <= 0 && quotas.StorageBytes <= 0 {
+		return nil
+	}
+
+	var freed int64
+	seen := map[string]bool{}
+	for _, key := range replaced {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if info, err := storage.Stat(key); err == nil {
+			freed += info.Size
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+
+	if quotas.EventBytes > 0 {
+		usage, err := GetEventUsage(eventID)
+		if err != nil {
+			return err
+		}
+		if after := usage.Total.Bytes - freed + size; after > quotas.EventBytes {
+			return fmt.Errorf("%w: event %d uses %s of %s, the upload needs %s",
+				ErrQuotaExceeded, eventID, formatBytes(usage.Total.Bytes), formatBytes(quotas.EventBytes), formatBytes(size))
+		}
+	}
+
+	if quotas.StorageBytes > 0 {
+		return reserveStorage(quotas.StorageBytes, size-freed)
+	}
+	return nil
+}
+
+// Recount the cached storage total once it is this old, and before refusing
+// an upload unless it was counted very recently
+const (
+	storageUsedTTL     = 10 * time.Minute
+	storageUsedRecount = 5 * time.Second
+)
+
+// storageUsed caches the total size of the storage for the global quota, so
+// uploads don't list every object. The event lock doesn't keep uploads to
+// different events apart, so each accepted upload is added to the total as
+// soon as it is checked. Deletions are not tracked and only show up when the
+// total is recounted; a recount may miss uploads still being written.
+var storageUsed struct {
+	sync.Mutex
+	bytes     int64
+	countedAt time.Time
+}
+
+// reserveStorage adds delta bytes to the storage total, failing with
+// ErrQuotaExceeded if that would go over limit
+func reserveStorage(limit, delta int64) error {
+	storageUsed.Lock()
+	defer storageUsed.Unlock()
+
+	age := time.Since(storageUsed.countedAt)
+	over := storageUsed.bytes+delta > limit
+	if storageUsed.countedAt.IsZero() || age > storageUsedTTL || (over && age > storageUsedRecount) {
+		objects, err := storage.List("")
+		if err != nil {
+			return err
+		}
+		var used int64
+		for _, obj := range objects {
+			used += obj.Size
+		}
+		storageUsed.bytes, storageUsed.countedAt = used, time.Now()
+	}
+
+	if used := storageUsed.bytes; used+delta > limit {
+		return fmt.Errorf("%w: storage uses %s of %s, the upload needs %s",
+			ErrQuotaExceeded, formatBytes(used), formatBytes(limit), formatBytes(delta))
+	}
+	storageUsed.bytes += delta
+	return nil
+}
+
+func formatBytes(n int64) string {
+	if n < megabyte {
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(n)/megabyte)
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"avatar-face-swap-go/internal/config"
+)
+
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// Storage backends
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend stores the pictures, face crops and avatars of every event.
+// Put replaces an object as a whole: readers see the old or the new content,
+// never a partial write.
+type Backend interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (*ObjectInfo, error)
+	List(prefix string) ([]ObjectInfo, error)
+	Delete(key string) error
+}
+
+// Presigner is implemented by backends that can hand out time-limited
+// download URLs, so clients fetch objects without going through the server
+type Presigner interface {
+	PresignGet(key string, expires time.Duration) (string, error)
+}
+
+// NewBackend creates the backend selected by cfg.StorageBackend
+func NewBackend(cfg *config.Config) (Backend, error) {
+	switch cfg.StorageBackend {
+	case BackendLocal, "":
+		return NewLocalBackend(cfg.StorageDir), nil
+	case BackendS3:
+		return NewS3Backend(S3Options{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			UsePathStyle:    cfg.S3UsePathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
+
+var (
+	defaultOnce    sync.Once
+	defaultBackend Backend
+	defaultErr     error
+)
+
+// Init creates the default backend from cfg. Later calls are no-ops; if Init
+// is never called the backend is created from config.Current() on first use.
+func Init(cfg *config.Config) error {
+	defaultOnce.Do(func() {
+		defaultBackend, defaultErr = NewBackend(cfg)
+	})
+	return defaultErr
+}
+
+// Default returns the backend used by the package level helpers
+func Default() (Backend, error) {
+	defaultOnce.Do(func() {
+		defaultBackend, defaultErr = NewBackend(config.Current())
+	})
+	if defaultErr != nil {
+		return nil, defaultErr
+	}
+	return defaultBackend, nil
+}
+
+func Put(key string, r io.Reader) error {
+	b, err := Default()
+	if err != nil {
+		return err
+	}
+	return b.Put(key, r)
+}
+
+// Write stores what write produces under key
+func Write(key string, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	return Put(key, &buf)
+}
+
+func Get(key string) (io.ReadCloser, error) {
+	b, err := Default()
+	if err != nil {
+		return nil, err
+	}
+	return b.Get(key)
+}
+
+func ReadFile(key string) ([]byte, error) {
+	r, err := Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func Stat(key string) (*ObjectInfo, error) {
+	b, err := Default()
+	if err != nil {
+		return nil, err
+	}
+	return b.Stat(key)
+}
+
+// Exists reports whether key exists; errors other than ErrNotFound count as
+// missing
+func Exists(key string) bool {
+	_, err := Stat(key)
+	return err == nil
+}
+
+func List(prefix string) ([]ObjectInfo, error) {
+	b, err := Default()
+	if err != nil {
+		return nil, err
+	}
+	return b.List(prefix)
+}
+
+// Delete removes key; deleting a missing object is not an error
+func Delete(key string) error {
+	b, err := Default()
+	if err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+// Move copies src to dst and removes src. It is not atomic across the two
+// keys, so callers hold the event lock.
+func Move(src, dst string) error {
+	r, err := Get(src)
+	if err != nil {
+		return err
+	}
+	err = Put(dst, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return Delete(src)
+}
+
+// MovePrefix moves every object below src to the same relative key below dst
+// and returns how many were moved
+func MovePrefix(src, dst string) (int, error) {
+	objects, err := List(src)
+	if err != nil {
+		return 0, err
+	}
+	for i, obj := range objects {
+		if err := Move(obj.Key, dst+strings.TrimPrefix(obj.Key, src)); err != nil {
+			return i, err
+		}
+	}
+	return len(objects), nil
+}
+
+// DeletePrefix removes every object below prefix and returns how many were removed
+func DeletePrefix(prefix string) (int, error) {
+	objects, err := List(prefix)
+	if err != nil {
+		return 0, err
+	}
+	for i, obj := range objects {
+		if err := Delete(obj.Key); err != nil {
+			return i, err
+		}
+	}
+	return len(objects), nil
+}
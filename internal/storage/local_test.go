@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// failingReader yields n bytes and then fails, like an upload cut off midway
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	k := min(len(p), r.n)
+	for i := range p[:k] {
+		p[i] = 'x'
+	}
+	r.n -= k
+	return k, nil
+}
+
+func TestLocalPutFailureLeavesNoPartialFile(t *testing.T) {
+	b := NewLocalBackend(t.TempDir())
+	key := "events/1/avatars/face_1.jpg"
+
+	if err := b.Put(key, &failingReader{n: 1000}); err == nil {
+		t.Fatal("Put succeeded on a failing reader")
+	}
+	if _, err := b.Stat(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stat after failed Put: %v, want ErrNotFound", err)
+	}
+
+	if err := b.Put(key, strings.NewReader("complete")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(key, &failingReader{n: 1000}); err == nil {
+		t.Fatal("Put succeeded on a failing reader")
+	}
+	if got := readAll(t, b, key); got != "complete" {
+		t.Fatalf("content after failed overwrite = %q, want the previous content", got)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(b.root, "events/1/avatars"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "face_1.jpg" {
+			t.Errorf("leftover file %s", e.Name())
+		}
+	}
+	objects, err := b.List("events/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != key {
+		t.Errorf("List = %v, want only %s", objects, key)
+	}
+}
+
+func TestLocalPutReadersNeverSeePartialContent(t *testing.T) {
+	b := NewLocalBackend(t.TempDir())
+	key := "events/1/original.jpg"
+
+	contents := make([]string, 8)
+	for i := range contents {
+		contents[i] = strings.Repeat(fmt.Sprint(i), 256<<10)
+	}
+	valid := map[string]bool{}
+	for _, c := range contents {
+		valid[c] = true
+	}
+	if err := b.Put(key, strings.NewReader(contents[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range contents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.Put(key, strings.NewReader(c)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				r, err := b.Get(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := io.ReadAll(r)
+				r.Close()
+				if err != nil || !valid[string(got)] {
+					t.Errorf("read %d bytes that match no complete write (err %v)", len(got), err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+}
+
+func readAll(t *testing.T, b Backend, key string) string {
+	t.Helper()
+	r, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "sync"
+
+var eventLocks sync.Map // event id -> *sync.Mutex
+
+// LockEvent serializes changes to the faces, avatars and files of one event.
+// It blocks until the lock is free and returns the function that releases it.
+//
+// The lock lives in this process only. Replicas sharing an S3 bucket do not
+// see each other's locks, so one replica must handle every write; others may
+// only serve reads.
+func LockEvent(eventID int) (unlock func()) {
+	mu, _ := eventLocks.LoadOrStore(eventID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
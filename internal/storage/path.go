@@ -2,52 +2,45 @@ package storage
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
-
-	"avatar-face-swap-go/internal/config"
+	"path"
 )
 
-func GetEventDir(eventID int) string {
-	cfg := config.Load()
-	return filepath.Join(cfg.StorageDir, "events", fmt.Sprintf("%d", eventID))
+// Keys name objects in the storage backend. They always use forward slashes;
+// the local backend maps them below StorageDir.
+
+func EventPrefix(eventID int) string {
+	return fmt.Sprintf("events/%d/", eventID)
 }
 
-func GetOriginalPath(eventID int) string {
-	return filepath.Join(GetEventDir(eventID), "original.jpg")
+func OriginalKey(eventID int) string {
+	return path.Join(EventPrefix(eventID), "original.jpg")
 }
 
-func GetMetadataPath(eventID int) string {
-	return filepath.Join(GetEventDir(eventID), "metadata.json")
+func MetadataKey(eventID int) string {
+	return path.Join(EventPrefix(eventID), "metadata.json")
 }
 
-func GetFacesDir(eventID int) string {
-	return filepath.Join(GetEventDir(eventID), "faces")
+func FacesPrefix(eventID int) string {
+	return path.Join(EventPrefix(eventID), "faces") + "/"
 }
 
-func GetFacePath(eventID int, filename string) string {
-	return filepath.Join(GetFacesDir(eventID), filename)
+func FaceKey(eventID int, filename string) string {
+	return FacesPrefix(eventID) + filename
 }
 
-func GetAvatarsDir(eventID int) string {
-	return filepath.Join(GetEventDir(eventID), "avatars")
+func AvatarsPrefix(eventID int) string {
+	return path.Join(EventPrefix(eventID), "avatars") + "/"
 }
 
-func GetAvatarPath(eventID int, filename string) string {
-	return filepath.Join(GetAvatarsDir(eventID), filename)
+func AvatarKey(eventID int, filename string) string {
+	return AvatarsPrefix(eventID) + filename
 }
 
-func EnsureEventDirs(eventID int) error {
-	dirs := []string{
-		GetEventDir(eventID),
-		GetFacesDir(eventID),
-		GetAvatarsDir(eventID),
-	}
+func CompositeKey(eventID int, format string) string {
+	return path.Join(EventPrefix(eventID), "composite."+format)
+}
 
-	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return err
-		}
-	}
-	return nil
+// TrashPrefix holds the objects of a deleted event until it is restored or purged
+func TrashPrefix(eventID int) string {
+	return "trash/" + EventPrefix(eventID)
 }